@@ -0,0 +1,730 @@
+package main
+
+import (
+	"fmt"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	gloss "github.com/charmbracelet/lipgloss"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Which kind of row an action applies to. Global actions are available
+// everywhere, the rest only when the cursor is on that kind of row.
+const (
+	CtxGlobal      = "global"
+	CtxLine        = "line"
+	CtxComment     = "comment"
+	CtxHeader      = "header"
+	CtxAbridgement = "abridgement"
+	// While lines are selected, see visual_line
+	CtxVisual = "visual"
+)
+
+// Columns moved by scroll_left and scroll_right.
+const hScrollStep = 4
+
+type actionSpec struct {
+	name    string
+	context string
+	// Default key sequences, see parseKeySequence
+	keys []string
+	// Ex commands which run this action
+	commands []string
+	desc     string
+}
+
+// Everything the user can do, in the order it's listed in the help overlay.
+// Actions without an entry in actionHandlers are handed to the region under
+// the cursor.
+var actionSpecs = []actionSpec{
+	{"quit", CtxGlobal, []string{"ctrl+c", "q"}, []string{"quit", "q"}, "Quit glimrr"},
+	{"help", CtxGlobal, []string{"?"}, []string{"help"}, "Show the keys available here"},
+	{"ex_mode", CtxGlobal, []string{":"}, nil, "Enter a command"},
+	{"cursor_up", CtxGlobal, []string{"up", "k"}, nil, "Move up a line"},
+	{"cursor_down", CtxGlobal, []string{"down", "j"}, nil, "Move down a line"},
+	{"cursor_top", CtxGlobal, []string{"gg"}, nil, "Go to the first line"},
+	{"cursor_bottom", CtxGlobal, []string{"G"}, nil, "Go to the last line"},
+	{"next_hunk", CtxGlobal, []string{"]c"}, nil, "Jump to the next change"},
+	{"prev_hunk", CtxGlobal, []string{"[c"}, nil, "Jump to the previous change"},
+	{"next_comment", CtxGlobal, []string{"]n"}, nil, "Jump to the next comment"},
+	{"prev_comment", CtxGlobal, []string{"[n"}, nil, "Jump to the previous comment"},
+	{"next_pending", CtxGlobal, []string{"]p"}, nil, "Jump to the next draft comment"},
+	{"prev_pending", CtxGlobal, []string{"[p"}, nil, "Jump to the previous draft comment"},
+	{"next_file", CtxGlobal, []string{"}"}, nil, "Jump to the next file"},
+	{"prev_file", CtxGlobal, []string{"{"}, nil, "Jump to the start of this file, or the previous one"},
+	{"set_mark", CtxGlobal, []string{"m"}, []string{"Mark"}, "Set a mark here, named by the next key"},
+	{"jump_mark", CtxGlobal, []string{"'"}, nil, "Jump to the mark named by the next key"},
+	{"half_page_down", CtxGlobal, []string{"ctrl+d"}, nil, "Scroll down half a screen"},
+	{"half_page_up", CtxGlobal, []string{"ctrl+u"}, nil, "Scroll up half a screen"},
+	{"scroll_left", CtxGlobal, []string{"zh", "left"}, nil, "Scroll long lines left"},
+	{"scroll_right", CtxGlobal, []string{"zl", "right"}, nil, "Scroll long lines right"},
+	{"scroll_left_half", CtxGlobal, []string{"zH"}, nil, "Scroll long lines left by half a screen"},
+	{"scroll_right_half", CtxGlobal, []string{"zL"}, nil, "Scroll long lines right by half a screen"},
+	{"scroll_start", CtxGlobal, []string{"zs"}, nil, "Scroll back to the start of lines"},
+	{"scroll_end", CtxGlobal, []string{"ze"}, nil, "Scroll to the end of the current line"},
+	{"toggle_wrap", CtxGlobal, nil, []string{"Wrap"}, "Toggle wrapping long lines instead of scrolling them"},
+	{"toggle_blame", CtxGlobal, []string{"gb"}, []string{"Blame"}, "Toggle showing who last changed each line"},
+	{"show_whitespace", CtxGlobal, nil, []string{"ShowWhitespace"}, "Toggle whitespace markers, or give none, trailing or all"},
+	{"toggle_file", CtxGlobal, []string{"t"}, nil, "Collapse or expand the current file"},
+	{"full_file", CtxGlobal, []string{"f"}, []string{"Full"}, "Show the whole of this file as of head, then base, then just the changes"},
+	{"goto_file", CtxGlobal, nil, []string{"File"}, "Jump to a file by its path"},
+	{"ignore_whitespace", CtxGlobal, nil, []string{"IgnoreWhitespace"}, "Toggle ignoring whitespace changes, add blank to ignore blank lines too"},
+	{"set_algorithm", CtxGlobal, nil, []string{"Algorithm"}, "Diff files locally with myers, patience or histogram, or use gitlab's"},
+	{"open_editor", CtxGlobal, []string{"gf"}, []string{"Edit"}, "Open the file in your editor at this line"},
+	{"open_browser", CtxGlobal, []string{"gx"}, []string{"Browse"}, "Open this line or comment on GitLab in a browser"},
+	{"list_commits", CtxGlobal, nil, []string{"Commits"}, "List the MR's commits"},
+	{"next_commit", CtxGlobal, []string{"]C"}, nil, "Review the next commit on its own, or the whole MR after the last"},
+	{"prev_commit", CtxGlobal, []string{"[C"}, nil, "Review the previous commit on its own, or the whole MR before the first"},
+	{"goto_commit", CtxGlobal, nil, []string{"Commit"}, "Review a commit by number or SHA, or the whole MR with none or all"},
+	{"collapse_all", CtxGlobal, nil, []string{"CollapseAll"}, "Collapse every file"},
+	{"expand_all", CtxGlobal, nil, []string{"ExpandAll"}, "Expand every file"},
+	{"refresh", CtxGlobal, nil, []string{"Refresh"}, "Check for new comments and pushes"},
+	{"submit", CtxGlobal, nil, []string{"Submit"}, "Post all draft comments"},
+	{"debug_load", CtxGlobal, nil, []string{"Load"}, "Show the loading screen for a bit"},
+	{"header_toggle", CtxHeader, []string{"enter"}, nil, "Collapse or expand this file"},
+	{"set_context", CtxGlobal, nil, []string{"Context"}, "Set how many lines are shown around changes"},
+	{"expand_context", CtxAbridgement, []string{"enter"}, nil, "Show more of the hidden lines"},
+	{"reveal_top", CtxAbridgement, []string{"J"}, nil, "Extend the code above downwards"},
+	{"reveal_bottom", CtxAbridgement, []string{"K"}, nil, "Extend the code below upwards"},
+	{"expand_scope", CtxAbridgement, []string{"s"}, nil, "Show the rest of the enclosing scope"},
+	{"expand_abridgement", CtxAbridgement, []string{"E"}, nil, "Show all of the hidden lines"},
+	{"jump_moved", CtxLine, []string{"gm"}, nil, "Jump to where this moved line came from or went"},
+	{"blame_commit", CtxLine, []string{"K"}, nil, "Show the commit which last changed this line"},
+	{"visual_line", CtxGlobal, []string{"V"}, nil, "Start or stop selecting lines"},
+	{"yank_line", CtxLine, []string{"yy"}, nil, "Copy this line"},
+	{"yank_permalink", CtxLine, []string{"yp"}, nil, "Copy a link to this line at the MR's head commit"},
+	{"yank_note", CtxComment, []string{"yy"}, nil, "Copy this comment's text"},
+	{"yank_selection", CtxVisual, []string{"y"}, nil, "Copy the selected lines"},
+	{"yank_selection_permalink", CtxVisual, []string{"Y"}, nil, "Copy a link to the selected lines"},
+	{"cancel_selection", CtxVisual, []string{"esc"}, nil, "Stop selecting lines"},
+	{"new_comment", CtxLine, []string{"c"}, nil, "Write a comment on this line"},
+	{"delete_comment", CtxComment, []string{"d"}, nil, "Delete this comment"},
+}
+
+func lookupAction(name string) *actionSpec {
+	for idx := range actionSpecs {
+		if actionSpecs[idx].name == name {
+			return &actionSpecs[idx]
+		}
+	}
+
+	return nil
+}
+
+func lookupCommand(command string) *actionSpec {
+	for idx := range actionSpecs {
+		for _, c := range actionSpecs[idx].commands {
+			if c == command {
+				return &actionSpecs[idx]
+			}
+		}
+	}
+
+	return nil
+}
+
+type ActionArgs struct {
+	// The region under the cursor and the cursor's position within it. region
+	// is nil if nothing has loaded yet.
+	region VRegion
+	cursor int
+	// Arguments given to the ex command, if the action came from one
+	args []string
+	// How many times to repeat the action, e.g. 10 for 10j. At least 1.
+	count int
+}
+
+type actionHandler func(m Model, a ActionArgs) (tea.Model, tea.Cmd)
+
+var actionHandlers map[string]actionHandler
+
+func init() {
+	actionHandlers = map[string]actionHandler{
+		"quit": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m, tea.Quit
+		},
+		"help": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			m.overlay = m.helpOverlay()
+			return m, nil
+		},
+		"ex_mode": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			m.exInput = textinput.New()
+			m.exInput.Focus()
+			m.exInput.Prompt = ":"
+			m.exInput.Width = m.w
+
+			if m.exHistory == nil {
+				m.exHistory = loadExHistory()
+			}
+			m.exHistory.pos = len(m.exHistory.entries)
+			m.exComplete = nil
+
+			m.mode = ExMode
+			return m, nil
+		},
+		"cursor_up": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			for i := 0; i < a.count; i++ {
+				(&m).moveCursor(-1)
+			}
+			(&m).scrollToCursor()
+			return m, nil
+		},
+		"cursor_down": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			for i := 0; i < a.count; i++ {
+				(&m).moveCursor(1)
+			}
+			(&m).scrollToCursor()
+			return m, nil
+		},
+		"cursor_top": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			m.y = 0
+			m.cursor = 0
+			return m, nil
+		},
+		"cursor_bottom": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			totalHeight := m.totalHeight()
+			m.y = Max(totalHeight-m.viewHeight(), 0)
+			m.cursor = totalHeight - 1
+			return m, nil
+		},
+		"half_page_down": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			totalHeight := m.totalHeight()
+			m.y = Max(Min(m.y+(m.h+1)/2, totalHeight-m.viewHeight()), 0)
+			(&m).moveCursor((m.h + 1) / 2)
+			(&m).scrollToCursor()
+			return m, nil
+		},
+		"half_page_up": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			m.y = Max(m.y-m.h/2, 0)
+			(&m).moveCursor(-(m.h + 1) / 2)
+			(&m).scrollToCursor()
+			return m, nil
+		},
+		"scroll_left": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			(&m).scrollX(m.x - hScrollStep)
+			return m, nil
+		},
+		"scroll_right": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			(&m).scrollX(m.x + hScrollStep)
+			return m, nil
+		},
+		"scroll_left_half": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			(&m).scrollX(m.x - m.w/2)
+			return m, nil
+		},
+		"scroll_right_half": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			(&m).scrollX(m.x + m.w/2)
+			return m, nil
+		},
+		"scroll_start": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			m.x = 0
+			return m, nil
+		},
+		"scroll_end": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			fr, ok := a.region.(*FileRegion)
+			if !ok || fr.GetRowType(a.cursor) != FRLine {
+				return m, nil
+			}
+
+			line := fr.ff.lines[fr.lineIdxAt(a.cursor)]
+			(&m).scrollX(line.Width(fr.tabWidth) - fr.codeWidth(m.viewParams(fr.lineNoColWidth)))
+			return m, nil
+		},
+		"toggle_wrap": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			m.settings.wrap = !m.settings.wrap
+			m.x = 0
+			(&m).relayout()
+
+			if m.settings.wrap {
+				return m.displayStatusMessage("Wrapping long lines.", 3*time.Second)
+			}
+			return m.displayStatusMessage("Scrolling long lines.", 3*time.Second)
+		},
+		"list_commits": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			if len(m.commits) == 0 {
+				return m.displayStatusMessage("ERR: The MR's commits haven't been listed.", 3*time.Second)
+			}
+
+			m.overlay = m.commitsOverlay()
+			return m, nil
+		},
+		"next_commit": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.stepCommit(a.count)
+		},
+		"prev_commit": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.stepCommit(-a.count)
+		},
+		"goto_commit": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.gotoCommit(a.args)
+		},
+		"toggle_blame": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.toggleBlame()
+		},
+		"blame_commit": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.showBlameCommit()
+		},
+		"show_whitespace": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			show := WhitespaceAll
+			if len(a.args) > 0 {
+				show = ""
+				for _, mode := range whitespaceModes {
+					if a.args[0] == mode {
+						show = mode
+					}
+				}
+				if show == "" {
+					return m.displayStatusMessage(
+						fmt.Sprintf("ERR: Unknown setting %q, expected one of %s.", a.args[0], strings.Join(whitespaceModes, ", ")),
+						3*time.Second,
+					)
+				}
+			} else if m.settings.showWhitespace != WhitespaceNone {
+				show = WhitespaceNone
+			}
+
+			m.settings.showWhitespace = show
+			if show == WhitespaceNone {
+				return m.displayStatusMessage("Not showing whitespace.", 3*time.Second)
+			}
+			return m.displayStatusMessage(fmt.Sprintf("Showing %s whitespace.", show), 3*time.Second)
+		},
+		"goto_file": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			if len(a.args) == 0 {
+				return m.displayStatusMessage("ERR: File needs a path.", 3*time.Second)
+			}
+
+			idx, err := m.findChange(strings.Join(a.args, " "))
+			if err != nil {
+				return m.displayStatusMessage(fmt.Sprintf("ERR: %s.", err), 3*time.Second)
+			}
+
+			m.cursor = 0
+			for _, region := range m.regions[:idx] {
+				m.cursor += region.Height()
+			}
+			m.y = m.cursor
+			(&m).clampCursor()
+			return m, nil
+		},
+		"set_context": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			if len(a.args) == 0 {
+				return m.displayStatusMessage(
+					fmt.Sprintf("Showing %d lines of context.", m.settings.contextLines),
+					3*time.Second,
+				)
+			}
+
+			lines, err := strconv.Atoi(a.args[0])
+			if err != nil || lines < 0 {
+				return m.displayStatusMessage("ERR: Context needs a number of lines.", 3*time.Second)
+			}
+
+			// Keep the same margin between the context and the threshold so
+			// small gaps still aren't hidden
+			m.settings.contextThreshold += lines - m.settings.contextLines
+			m.settings.contextLines = lines
+
+			anchor := m.anchorCursor()
+			for _, region := range m.regions {
+				if fr, ok := region.(*FileRegion); ok {
+					fr.SetContext(m.viewParams(fr.lineNoColWidth))
+				}
+			}
+			(&m).restoreCursor(anchor)
+			(&m).clampCursor()
+			return m, nil
+		},
+		"ignore_whitespace": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			opts := m.diffOpts
+			blank := false
+			for _, arg := range a.args {
+				if arg != "blank" {
+					return m.displayStatusMessage(fmt.Sprintf("ERR: Unknown option %q.", arg), 3*time.Second)
+				}
+				blank = true
+			}
+
+			if opts.IgnoreWhitespace && opts.IgnoreBlankLines == blank {
+				opts.IgnoreWhitespace, opts.IgnoreBlankLines = false, false
+			} else {
+				opts.IgnoreWhitespace, opts.IgnoreBlankLines = true, blank
+			}
+
+			status := "Not ignoring whitespace."
+			if opts.IgnoreBlankLines {
+				status = "Ignoring whitespace and blank lines."
+			} else if opts.IgnoreWhitespace {
+				status = "Ignoring whitespace."
+			}
+
+			return m.setDiffOptions(opts, status)
+		},
+		"set_algorithm": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			if len(a.args) == 0 {
+				algorithm := m.diffOpts.Algorithm
+				if !m.diffOpts.Active() {
+					algorithm = AlgorithmGitLab
+				} else if algorithm == "" || algorithm == AlgorithmGitLab {
+					algorithm = AlgorithmMyers
+				}
+				return m.displayStatusMessage(fmt.Sprintf("Diffing with %s.", algorithm), 3*time.Second)
+			}
+
+			for _, algorithm := range diffAlgorithms {
+				if a.args[0] == algorithm {
+					opts := m.diffOpts
+					opts.Algorithm = algorithm
+					return m.setDiffOptions(opts, fmt.Sprintf("Diffing with %s.", algorithm))
+				}
+			}
+
+			return m.displayStatusMessage(
+				fmt.Sprintf("ERR: Unknown algorithm %q, expected one of %s.", a.args[0], strings.Join(diffAlgorithms, ", ")),
+				3*time.Second,
+			)
+		},
+		"next_hunk": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.repeatJump(a.count, 1, isHunkStart, "No more changes below.")
+		},
+		"prev_hunk": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.repeatJump(a.count, -1, isHunkStart, "No more changes above.")
+		},
+		"next_comment": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.repeatJump(a.count, 1, isCommentRow, "No more comments below.")
+		},
+		"prev_comment": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.repeatJump(a.count, -1, isCommentRow, "No more comments above.")
+		},
+		"next_pending": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.repeatJump(a.count, 1, isPendingCommentRow, "No more drafts below.")
+		},
+		"prev_pending": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.repeatJump(a.count, -1, isPendingCommentRow, "No more drafts above.")
+		},
+		"next_file": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.repeatJump(a.count, 1, isHeaderRow, "This is the last file.")
+		},
+		"prev_file": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.repeatJump(a.count, -1, isHeaderRow, "This is the first file.")
+		},
+		"set_mark": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			if len(a.args) == 0 {
+				m.awaitingArg = "set_mark"
+				return m, nil
+			}
+			return m.setMark(a.args[0])
+		},
+		"jump_mark": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			if len(a.args) == 0 {
+				m.awaitingArg = "jump_mark"
+				return m, nil
+			}
+			return m.jumpToMark(a.args[0])
+		},
+		"open_editor": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.openInEditor()
+		},
+		"open_browser": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.openInBrowser()
+		},
+		"visual_line": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.toggleSelection()
+		},
+		"yank_line": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.yankLine()
+		},
+		"yank_permalink": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.yankPermalink()
+		},
+		"yank_note": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.yankNote()
+		},
+		"yank_selection": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.yankSelection()
+		},
+		"yank_selection_permalink": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.yankSelectionPermalink()
+		},
+		"cancel_selection": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			m.selection = nil
+			return m, nil
+		},
+		"jump_moved": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.jumpToMoved()
+		},
+		"collapse_all": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			for _, region := range m.regions {
+				region.SetECState(true)
+			}
+			(&m).clampCursor()
+			return m, nil
+		},
+		"expand_all": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			anchor := m.anchorCursor()
+			for _, region := range m.regions {
+				region.SetECState(false)
+			}
+			(&m).restoreCursor(anchor)
+			return m, nil
+		},
+		"refresh": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			if m.refreshing {
+				return m.displayStatusMessage("Refresh already in progress.", 3*time.Second)
+			}
+			return m.startRefresh(true)
+		},
+		"submit": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.submitComments()
+		},
+		"debug_load": func(m Model, a ActionArgs) (tea.Model, tea.Cmd) {
+			return m.doBlockingLoad("Loading stuff...", func() tea.Msg {
+				time.Sleep(3 * time.Second)
+				return nil
+			})
+		},
+	}
+}
+
+// The context for actions given the row the cursor is on.
+func (m Model) cursorContext() string {
+	if len(m.regions) == 0 {
+		return CtxGlobal
+	}
+	if m.selection != nil {
+		return CtxVisual
+	}
+
+	region, relCursor := m.getCursorTarget(m.cursor)
+	switch region.GetRowType(relCursor) {
+	case FRLine:
+		return CtxLine
+	case FRComment:
+		return CtxComment
+	case FRHeader:
+		return CtxHeader
+	case FRAbr:
+		return CtxAbridgement
+	}
+
+	return CtxGlobal
+}
+
+// Feeds a key press into the pending key sequence, running an action once
+// the sequence matches a binding.
+func (m Model) handleKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	key := msg.String()
+
+	// The key is the argument to the last action, e.g. the name of a mark
+	if m.awaitingArg != "" {
+		action := m.awaitingArg
+		m.awaitingArg = ""
+		if key == "esc" {
+			m.count = 0
+			return m, nil
+		}
+		return m.runAction(action, []string{key})
+	}
+
+	// Digits before a key sequence are a count. A leading 0 isn't, as in vim.
+	if len(m.pendingKeys) == 0 && len(key) == 1 && key[0] >= '0' && key[0] <= '9' && (key != "0" || m.count > 0) {
+		m.count = m.count*10 + int(key[0]-'0')
+		return m, nil
+	}
+
+	m.pendingKeys = append(m.pendingKeys, key)
+
+	action, isPrefix := CFG.MatchKeys(m.cursorContext(), m.pendingKeys)
+	if action != "" {
+		m.pendingKeys = nil
+		return m.runAction(action, nil)
+	}
+
+	if isPrefix {
+		return m, nil
+	}
+
+	// A dead end. Give the last key a chance to start a sequence of its own.
+	if len(m.pendingKeys) > 1 {
+		m.pendingKeys = nil
+		return m.handleKey(msg)
+	}
+
+	m.pendingKeys = nil
+	m.count = 0
+	return m, nil
+}
+
+func (m Model) runAction(name string, args []string) (tea.Model, tea.Cmd) {
+	a := ActionArgs{args: args, count: Max(m.count, 1)}
+	m.count = 0
+	if len(m.regions) > 0 {
+		a.region, a.cursor = m.getCursorTarget(m.cursor)
+	}
+
+	if handler, ok := actionHandlers[name]; ok {
+		return handler(m, a)
+	}
+
+	if a.region == nil {
+		return m, nil
+	}
+
+	return a.region.HandleAction(&m, name, a.cursor)
+}
+
+type Overlay struct {
+	title string
+	lines []string
+}
+
+func (m Model) helpOverlay() *Overlay {
+	ctx := m.cursorContext()
+	overlay := &Overlay{title: fmt.Sprintf("Keys (%s)", ctx)}
+
+	for _, spec := range actionSpecs {
+		if spec.context != CtxGlobal && spec.context != ctx {
+			continue
+		}
+
+		keys := strings.Join(CFG.Keys[spec.name], ", ")
+		if keys == "" && len(spec.commands) > 0 {
+			keys = ":" + spec.commands[0]
+		}
+		if keys == "" {
+			continue
+		}
+
+		overlay.lines = append(overlay.lines, fmt.Sprintf("%-16s %s", keys, spec.desc))
+	}
+
+	return overlay
+}
+
+func (o *Overlay) View(w int, h int) string {
+	body := strings.Join(o.lines, "\n")
+	box := gloss.NewStyle().
+		Border(gloss.RoundedBorder()).
+		BorderForeground(CFG.Colors.CursorHeader).
+		Padding(0, 1).
+		MaxWidth(w).
+		MaxHeight(h).
+		Render(fmt.Sprintf(
+			"%s\n\n%s\n\n%s",
+			gloss.NewStyle().Bold(true).Render(o.title),
+			body,
+			gloss.NewStyle().Foreground(CFG.Colors.NoteRule).Render("Press any key to close"),
+		))
+
+	return gloss.Place(w, h, gloss.Center, gloss.Center, box)
+}
+
+type keyBinding struct {
+	keys   []string
+	label  string
+	action string
+}
+
+// Key names as reported by bubbletea which are more than one character
+// long. Anything else longer than a character is a sequence of single keys,
+// e.g. "gg" or "]c". Sequences involving named keys are space separated,
+// e.g. "g enter".
+var namedKeys = map[string]bool{
+	"enter": true, "tab": true, "esc": true, "backspace": true, "delete": true,
+	"insert": true, "up": true, "down": true, "left": true, "right": true,
+	"home": true, "end": true, "pgup": true, "pgdown": true, " ": true,
+}
+
+func parseKeySequence(s string) []string {
+	if namedKeys[s] || strings.Contains(s, "+") || (strings.HasPrefix(s, "f") && len(s) <= 3 && len(s) > 1) {
+		return []string{s}
+	}
+
+	if strings.Contains(strings.TrimSpace(s), " ") {
+		return strings.Fields(s)
+	}
+
+	var keys []string
+	for _, r := range s {
+		keys = append(keys, string(r))
+	}
+	return keys
+}
+
+func isKeyPrefix(prefix []string, keys []string) bool {
+	if len(prefix) > len(keys) {
+		return false
+	}
+
+	for idx := range prefix {
+		if prefix[idx] != keys[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Builds the per-context binding table, reporting unknown actions and
+// bindings which clash with or shadow one another.
+func buildBindings(keys map[string][]string) (map[string][]keyBinding, []string) {
+	var problems []string
+	bindings := make(map[string][]keyBinding)
+	var all []keyBinding
+
+	for _, action := range sortedKeys(keys) {
+		spec := lookupAction(action)
+		if spec == nil {
+			problems = append(problems, fmt.Sprintf("Keys: unknown action %q", action))
+			continue
+		}
+
+		for _, label := range keys[action] {
+			binding := keyBinding{
+				keys:   parseKeySequence(label),
+				label:  label,
+				action: action,
+			}
+
+			for _, other := range all {
+				otherCtx := lookupAction(other.action).context
+				if otherCtx != spec.context && otherCtx != CtxGlobal && spec.context != CtxGlobal {
+					continue
+				}
+
+				if isKeyPrefix(other.keys, binding.keys) || isKeyPrefix(binding.keys, other.keys) {
+					problems = append(problems, fmt.Sprintf(
+						"Keys: %q for %s clashes with %q for %s",
+						label,
+						action,
+						other.label,
+						other.action,
+					))
+				}
+			}
+
+			all = append(all, binding)
+			bindings[spec.context] = append(bindings[spec.context], binding)
+		}
+	}
+
+	return bindings, problems
+}
+
+// Finds the action bound to pending in ctx. If there's no match but pending
+// could still become one, isPrefix is true.
+func (c *GLIMRRConfig) MatchKeys(ctx string, pending []string) (action string, isPrefix bool) {
+	for _, bindingCtx := range []string{ctx, CtxGlobal} {
+		for _, binding := range c.bindings[bindingCtx] {
+			if isKeyPrefix(pending, binding.keys) {
+				if len(pending) == len(binding.keys) {
+					return binding.action, false
+				}
+				isPrefix = true
+			}
+		}
+	}
+
+	return "", isPrefix
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mattn/go-runewidth"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// Columns taken by the blame gutter: a short SHA, the author and the age.
+const (
+	blameAuthorWidth = 12
+	blameWidth       = 8 + 1 + blameAuthorWidth + 1 + 4 + 1
+)
+
+// The result of blaming one file's base version.
+type loadedBlame struct {
+	region  *FileRegion
+	commits []*GLCommit
+	err     error
+}
+
+type BlameLoadedMsg struct {
+	results []loadedBlame
+}
+
+// Finds which commit last changed each line of path as of ref, in the local
+// clone if it has ref, otherwise with GitLab's blame API.
+func fetchBlame(gl *GLInstance, pid string, path string, ref string) ([]*GLCommit, error) {
+	if commits, ok := localBlame(path, ref); ok {
+		return commits, nil
+	}
+
+	ranges, err := gl.FetchBlame(pid, path, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []*GLCommit
+	for idx := range ranges {
+		for range ranges[idx].Lines {
+			commits = append(commits, &ranges[idx].Commit)
+		}
+	}
+
+	return commits, nil
+}
+
+// Blames the base side of regions in the background. Only unchanged and
+// removed lines are blamed, since added lines are the MR's (or the commit's)
+// own.
+func (m Model) loadBlame(regions []*FileRegion) tea.Cmd {
+	gl, pid := m.gl, m.initData.project
+
+	var wanted []*FileRegion
+	refs := make(map[*FileRegion]string)
+	for _, region := range regions {
+		if region.blame == nil && !region.added {
+			wanted = append(wanted, region)
+			refs[region] = m.refsOf(region).BaseSHA
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	return func() tea.Msg {
+		msg := BlameLoadedMsg{}
+		results := make(chan loadedBlame, len(wanted))
+		work := make(chan *FileRegion)
+
+		for i := 0; i < CFG.Workers; i++ {
+			go func() {
+				for region := range work {
+					commits, err := fetchBlame(gl, pid, region.oldPath, refs[region])
+					results <- loadedBlame{region: region, commits: commits, err: err}
+				}
+			}()
+		}
+		for _, region := range wanted {
+			work <- region
+		}
+		close(work)
+
+		for range wanted {
+			msg.results = append(msg.results, <-results)
+		}
+
+		return msg
+	}
+}
+
+func (m Model) applyBlame(msg BlameLoadedMsg) (tea.Model, tea.Cmd) {
+	failed := 0
+	for _, result := range msg.results {
+		if result.err != nil {
+			log.Error().Err(result.err).Str("path", result.region.oldPath).Msg("Unable to blame file.")
+			failed++
+			continue
+		}
+
+		result.region.blame = result.commits
+	}
+
+	if failed > 0 {
+		return m.displayStatusMessage(fmt.Sprintf("ERR: Unable to blame %d files.", failed), 3*time.Second)
+	}
+
+	return m, nil
+}
+
+func (m Model) toggleBlame() (tea.Model, tea.Cmd) {
+	m.settings.blame = !m.settings.blame
+	// The gutter changes width, which moves where lines wrap
+	(&m).relayout()
+
+	if !m.settings.blame {
+		return m.displayStatusMessage("Hiding blame.", 3*time.Second)
+	}
+
+	var regions []*FileRegion
+	for _, region := range m.regions {
+		if fr, ok := region.(*FileRegion); ok {
+			regions = append(regions, fr)
+		}
+	}
+
+	next, statusCmd := m.displayStatusMessage("Showing blame.", 3*time.Second)
+	return next, tea.Batch(statusCmd, m.loadBlame(regions))
+}
+
+func (f *FileRegion) showsBlame(vp *ViewParams) bool {
+	return vp.settings.blame && !f.added
+}
+
+// The commit which last changed line before the MR, nil for added lines or
+// while blame is loading.
+func (f *FileRegion) blameOf(line *FormattedLine) *GLCommit {
+	if line.mode == ADDED || line.aNum < 1 || line.aNum > len(f.blame) {
+		return nil
+	}
+
+	return f.blame[line.aNum-1]
+}
+
+// The blame gutter for line, blank where there's no blame for it.
+func (f *FileRegion) blameGutter(line *FormattedLine) string {
+	commit := f.blameOf(line)
+	if commit == nil {
+		return strings.Repeat(" ", blameWidth)
+	}
+
+	author := runewidth.FillRight(runewidth.Truncate(commit.AuthorName, blameAuthorWidth, "…"), blameAuthorWidth)
+	return fmt.Sprintf("%-8.8s %s %4s ", commit.Id, author, shortAge(commit.AuthoredDate, time.Now()))
+}
+
+// How long before now date (in RFC 3339 format) was, in at most four columns.
+func shortAge(date string, now time.Time) string {
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return "?"
+	}
+
+	age := now.Sub(t)
+	days := int(age.Hours() / 24)
+	switch {
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", Max(int(age.Minutes()), 0))
+	case days < 1:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	case days < 30:
+		return fmt.Sprintf("%dd", days)
+	case days < 365:
+		return fmt.Sprintf("%dmo", days/30)
+	}
+
+	return fmt.Sprintf("%dy", days/365)
+}
+
+// Shows the whole of the commit which last changed the line under the cursor.
+func (m Model) showBlameCommit() (tea.Model, tea.Cmd) {
+	loc, ok := m.cursorLocation()
+	if !ok || loc.line == nil {
+		return m, nil
+	}
+
+	commit := loc.region.blameOf(loc.line)
+	if commit == nil {
+		if loc.line.mode == ADDED {
+			return m.displayStatusMessage("This line is new, so there's no blame for it.", 3*time.Second)
+		}
+		return m.displayStatusMessage("No blame for this line, show it with :Blame.", 3*time.Second)
+	}
+
+	// Blame from the local clone only has the first line of the message
+	message := commit.Message
+	if message == "" {
+		message, ok = localCommitMessage(commit.Id)
+		if !ok {
+			message = commit.Title
+		}
+	}
+
+	date := commit.AuthoredDate
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		date = t.Local().Format("Mon Jan 2 15:04:05 2006")
+	}
+
+	m.overlay = &Overlay{
+		title: fmt.Sprintf("Commit %s", commit.Id),
+		lines: append(
+			[]string{
+				fmt.Sprintf("Author: %s", commit.AuthorName),
+				fmt.Sprintf("Date:   %s", date),
+				"",
+			},
+			strings.Split(strings.TrimRight(message, "\n"), "\n")...,
+		),
+	}
+
+	return m, nil
+}
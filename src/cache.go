@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata for a cached response. Stored alongside the body as <key>.json,
+// with the body itself in <key>.body. The body's mtime doubles as the last
+// access time for LRU eviction so hits don't require rewriting metadata.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Immutable    bool   `json:"immutable,omitempty"`
+	// Response headers which are needed again on a hit, e.g. for pagination
+	Headers  map[string]string `json:"headers,omitempty"`
+	Size     int64             `json:"size"`
+	accessed time.Time
+}
+
+// An on-disk HTTP response cache keyed by URL. A nil *HTTPCache is valid and
+// simply never has anything in it.
+type HTTPCache struct {
+	dir      string
+	maxBytes int64
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	size     int64
+}
+
+func defaultCacheDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(base, "glimrr"), nil
+}
+
+func NewHTTPCache(dir string, maxBytes int64) (*HTTPCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &HTTPCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*cacheEntry),
+	}
+
+	metaPaths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, metaPath := range metaPaths {
+		key := strings.TrimSuffix(filepath.Base(metaPath), ".json")
+		var entry cacheEntry
+
+		data, err := os.ReadFile(metaPath)
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(c.bodyPath(key))
+		}
+
+		if err != nil {
+			log.Debug().Err(err).Str("key", key).Msg("Discarding unreadable cache entry.")
+			c.remove(key)
+			continue
+		}
+
+		entry.Size = info.Size()
+		entry.accessed = info.ModTime()
+		c.entries[key] = &entry
+		c.size += entry.Size
+	}
+
+	log.Debug().
+		Str("dir", dir).
+		Int("entries", len(c.entries)).
+		Int64("bytes", c.size).
+		Msg("Restored HTTP cache.")
+
+	c.evict()
+	return c, nil
+}
+
+func cacheKey(url string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(url)))
+}
+
+func (c *HTTPCache) bodyPath(key string) string {
+	return filepath.Join(c.dir, key+".body")
+}
+
+func (c *HTTPCache) metaPath(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// Returns the cached entry and body for url, if there is one.
+func (c *HTTPCache) Lookup(url string) (*cacheEntry, []byte, bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(url)
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+
+	body, err := os.ReadFile(c.bodyPath(key))
+	if err != nil {
+		log.Error().Err(err).Str("url", url).Msg("Unable to read cached body.")
+		c.drop(key)
+		return nil, nil, false
+	}
+
+	c.touch(key)
+	return entry, body, true
+}
+
+func (c *HTTPCache) Store(entry cacheEntry, body []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(entry.URL)
+	c.drop(key)
+	entry.Size = int64(len(body))
+
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		log.Error().Err(err).Str("url", entry.URL).Msg("Unable to serialize cache entry.")
+		return
+	}
+
+	// Write the body first and rename into place so a crash never leaves
+	// metadata pointing at a partial body.
+	tmpPath := c.bodyPath(key) + ".tmp"
+	err = os.WriteFile(tmpPath, body, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, c.bodyPath(key))
+	}
+	if err == nil {
+		err = os.WriteFile(c.metaPath(key), meta, 0600)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("url", entry.URL).Msg("Unable to write cache entry.")
+		c.remove(key)
+		return
+	}
+
+	entry.accessed = time.Now()
+	c.entries[key] = &entry
+	c.size += entry.Size
+
+	c.evict()
+}
+
+// Drops the entry for url, if present.
+func (c *HTTPCache) Invalidate(url string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.drop(cacheKey(url))
+}
+
+// Drops every entry whose URL starts with prefix.
+func (c *HTTPCache) InvalidatePrefix(prefix string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if strings.HasPrefix(entry.URL, prefix) {
+			c.drop(key)
+		}
+	}
+}
+
+func (c *HTTPCache) touch(key string) {
+	now := time.Now()
+	c.entries[key].accessed = now
+	os.Chtimes(c.bodyPath(key), now, now)
+}
+
+func (c *HTTPCache) drop(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.size -= entry.Size
+		delete(c.entries, key)
+		c.remove(key)
+	}
+}
+
+func (c *HTTPCache) remove(key string) {
+	os.Remove(c.metaPath(key))
+	os.Remove(c.bodyPath(key))
+}
+
+// Removes least recently used entries until the cache fits in maxBytes.
+func (c *HTTPCache) evict() {
+	if c.size <= c.maxBytes {
+		return
+	}
+
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].accessed.Before(c.entries[keys[j]].accessed)
+	})
+
+	for _, key := range keys {
+		if c.size <= c.maxBytes {
+			break
+		}
+		log.Debug().Str("url", c.entries[key].URL).Msg("Evicting cache entry.")
+		c.drop(key)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// The result of posting one draft comment to GitLab.
+type submittedComment struct {
+	draft   *GLNote
+	created GLNote
+	err     error
+}
+
+type CommentsSubmittedMsg struct {
+	results []submittedComment
+}
+
+type CommentDeletedMsg struct {
+	region  *FileRegion
+	comment Comment
+	err     error
+}
+
+// Posts every draft comment in the background. The drafts are only replaced
+// with the created notes once the results are back in applySubmitted.
+func (m Model) submitComments() (tea.Model, tea.Cmd) {
+	var drafts []*GLNote
+	for _, region := range m.mrRegionList() {
+		for _, comment := range region.GetPendingComments() {
+			drafts = append(drafts, comment.(*GLNote))
+		}
+	}
+	if len(drafts) == 0 {
+		return m.displayStatusMessage("No draft comments to submit.", 3*time.Second)
+	}
+
+	// Copied so the Cmd doesn't read the drafts while Update may change them
+	bodies := make([]GLNote, len(drafts))
+	for idx, draft := range drafts {
+		bodies[idx] = *draft
+	}
+	gl, mr := m.gl, m.mr
+
+	return m.doBlockingLoad("Submitting review...", func() tea.Msg {
+		msg := CommentsSubmittedMsg{}
+		for idx, draft := range drafts {
+			result := submittedComment{draft: draft}
+
+			discussion, err := gl.CreateComment(bodies[idx], mr)
+			if err == nil && len(discussion.Notes) == 0 {
+				err = fmt.Errorf("discussion %s has no notes", discussion.Id)
+			}
+			if err != nil {
+				result.err = err
+			} else {
+				result.created = discussion.Notes[0]
+				result.created.DiscussionId = discussion.Id
+			}
+
+			msg.results = append(msg.results, result)
+		}
+		gl.InvalidateDiscussions(mr)
+
+		return msg
+	})
+}
+
+func (m Model) applySubmitted(msg CommentsSubmittedMsg) (tea.Model, tea.Cmd) {
+	failed := 0
+	for _, result := range msg.results {
+		if result.err != nil {
+			log.Error().Err(result.err).Str("path", result.draft.Position.NewPath).Msg("Unable to submit comment.")
+			failed++
+			continue
+		}
+
+		// The draft is now a real note, so refreshes should recognise it
+		// rather than duplicate it.
+		*result.draft = result.created
+	}
+
+	if failed > 0 {
+		return m.displayStatusMessage(
+			fmt.Sprintf("ERR: Unable to submit %d of %d comments, they're still drafts.", failed, len(msg.results)),
+			3*time.Second,
+		)
+	}
+
+	return m.displayStatusMessage(fmt.Sprintf("Submitted %d comments.", len(msg.results)), 3*time.Second)
+}
+
+// Deletes comment from f, on GitLab too unless it's a draft.
+func (m Model) deleteComment(f *FileRegion, comment Comment) (tea.Model, tea.Cmd) {
+	if comment.IsPending() {
+		return m.applyDeleted(CommentDeletedMsg{region: f, comment: comment})
+	}
+
+	gl, mr := m.gl, m.mr
+	return m.doBlockingLoad("Deleting comment...", func() tea.Msg {
+		err := gl.DeleteComment(comment, mr)
+		if err == nil {
+			gl.InvalidateDiscussions(mr)
+		}
+
+		return CommentDeletedMsg{region: f, comment: comment, err: err}
+	})
+}
+
+func (m Model) applyDeleted(msg CommentDeletedMsg) (tea.Model, tea.Cmd) {
+	if msg.err != nil {
+		log.Error().Err(msg.err).Msg("Unable to delete comment.")
+		return m.displayStatusMessage("ERR: Unable to delete comment.", 3*time.Second)
+	}
+
+	f := msg.region
+	for idx, comment := range f.comments {
+		if comment == msg.comment {
+			f.comments = append(f.comments[:idx], f.comments[idx+1:]...)
+			break
+		}
+	}
+	f.updateLineMap(m.viewParams(f.lineNoColWidth))
+	if f.inCommit != nil {
+		f.inCommit.forgetComment(msg.comment)
+	}
+	(&m).clampCursor()
+
+	return m, nil
+}
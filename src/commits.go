@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How a region showing one commit's changes relates to the MR as a whole.
+// Comments are positioned against the MR's diff, so they can only be shown
+// (or written) on a commit's lines where its version of the file is the same
+// as the MR's.
+type commitFile struct {
+	commit *GLCommit
+	// The MR's region for the same file, nil if the MR doesn't change it
+	mrFile *FileRegion
+	// Whether each side of this commit's diff is the same as that side of
+	// the MR's, so line numbers on it carry over
+	baseMatches bool
+	headMatches bool
+}
+
+type CommitsLoadedMsg struct {
+	commits []GLCommit
+	err     error
+}
+
+// The regions for one commit's changes, ready to be shown.
+type CommitLoadedMsg struct {
+	commit  *GLCommit
+	regions []VRegion
+	err     error
+}
+
+// The revisions a commit's diff is between.
+func (c *GLCommit) diffRefs() GLDiffRefs {
+	parent := ""
+	if len(c.ParentIds) > 0 {
+		parent = c.ParentIds[0]
+	}
+
+	return GLDiffRefs{BaseSHA: parent, StartSHA: parent, HeadSHA: c.Id}
+}
+
+// The revisions fr's diff is between: the MR's, or a single commit's.
+func (m Model) refsOf(fr *FileRegion) GLDiffRefs {
+	if fr.inCommit != nil {
+		return fr.inCommit.commit.diffRefs()
+	}
+
+	return m.mr.DiffRefs
+}
+
+// The regions of the whole MR, whether or not they're what's being shown.
+func (m Model) mrRegionList() []VRegion {
+	if m.viewedCommit != nil {
+		return m.mrRegions
+	}
+
+	return m.regions
+}
+
+// Translates a comment's position in the MR's diff to this commit's. Only
+// line numbers on sides which match carry over, and comments with neither
+// can't be shown.
+func (c *commitFile) commitPosition(pos CommentPosition) (CommentPosition, bool) {
+	if !c.headMatches {
+		pos.NewLine = 0
+	}
+	if !c.baseMatches {
+		pos.OldLine = 0
+	}
+
+	return pos, pos.NewLine > 0 || pos.OldLine > 0
+}
+
+// Translates line numbers in this commit's diff to the MR's, for positioning
+// new comments. ok is false if the line isn't in a version of the file the
+// MR's diff has.
+func (c *commitFile) mrLines(oldLine int, newLine int) (int, int, bool) {
+	if c.mrFile == nil {
+		return 0, 0, false
+	}
+
+	useHead := c.headMatches && newLine > 0
+	useBase := !useHead && c.baseMatches && oldLine > 0
+	for _, line := range c.mrFile.ff.lines {
+		if (useHead && line.mode != REMOVED && line.bNum == newLine) ||
+			(useBase && line.mode != ADDED && line.aNum == oldLine) {
+			o, n := c.mrFile.commentLines(line)
+			return o, n, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// Keeps a draft written on a commit with the rest of the MR's comments, so it
+// gets submitted and still shows after going back to the whole MR.
+func (c *commitFile) addComment(comment Comment) {
+	c.mrFile.comments = append(c.mrFile.comments, comment)
+}
+
+func (c *commitFile) forgetComment(comment Comment) {
+	if c.mrFile == nil {
+		return
+	}
+
+	for idx, other := range c.mrFile.comments {
+		if other == comment {
+			c.mrFile.comments = append(c.mrFile.comments[:idx], c.mrFile.comments[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Lists the MR's commits in the background, oldest first.
+func (m Model) loadCommits() tea.Cmd {
+	gl, mr := m.gl, m.mr
+
+	return func() tea.Msg {
+		commits, err := gl.FetchMRCommits(mr.ProjectId, mr.Iid)
+		for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+			commits[i], commits[j] = commits[j], commits[i]
+		}
+
+		return CommitsLoadedMsg{commits: commits, err: err}
+	}
+}
+
+func (m Model) applyCommits(msg CommitsLoadedMsg) (tea.Model, tea.Cmd) {
+	if msg.err != nil {
+		log.Error().Err(msg.err).Msg("Unable to list the MR's commits.")
+		return m, nil
+	}
+
+	m.commits = msg.commits
+	// A push may have rewritten the commit being reviewed, in which case
+	// there's nothing to step on from
+	if m.viewedCommit != nil && m.viewedCommitIdx() < 0 {
+		return m.returnToMR(fmt.Sprintf(
+			"Commit %.8s is no longer in the MR, showing the whole MR.",
+			m.viewedCommit.Id,
+		))
+	}
+
+	return m, nil
+}
+
+// Index into m.commits of the commit being reviewed, -1 for the whole MR.
+func (m Model) viewedCommitIdx() int {
+	if m.viewedCommit == nil {
+		return -1
+	}
+
+	for idx, commit := range m.commits {
+		if commit.Id == m.viewedCommit.Id {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// Moves count commits forwards (or backwards, when negative), going via the
+// whole MR at either end.
+func (m Model) stepCommit(count int) (tea.Model, tea.Cmd) {
+	if len(m.commits) == 0 {
+		return m.displayStatusMessage("ERR: The MR's commits haven't been listed.", 3*time.Second)
+	}
+
+	// Position -1 is the whole MR, which comes before the first commit
+	n := len(m.commits) + 1
+	idx := ((m.viewedCommitIdx()+1+count)%n+n)%n - 1
+
+	return m.showCommit(idx)
+}
+
+// Shows the commit named by args, either its number in the list or the start
+// of its SHA. Without one, or with "all", goes back to the whole MR.
+func (m Model) gotoCommit(args []string) (tea.Model, tea.Cmd) {
+	if len(args) == 0 || args[0] == "all" {
+		return m.showCommit(-1)
+	}
+
+	if n, err := strconv.Atoi(args[0]); err == nil && n >= 1 && n <= len(m.commits) {
+		return m.showCommit(n - 1)
+	}
+	for idx, commit := range m.commits {
+		if len(args[0]) >= 4 && strings.HasPrefix(commit.Id, args[0]) {
+			return m.showCommit(idx)
+		}
+	}
+
+	return m.displayStatusMessage(fmt.Sprintf("ERR: No commit %q in this MR.", args[0]), 3*time.Second)
+}
+
+func (m Model) commitsOverlay() *Overlay {
+	current := m.viewedCommitIdx()
+	overlay := &Overlay{title: "Commits (showing the whole MR)"}
+	if current >= 0 {
+		overlay.title = fmt.Sprintf("Commits (showing %d of %d)", current+1, len(m.commits))
+	}
+
+	for idx, commit := range m.commits {
+		marker := " "
+		if idx == current {
+			marker = "▶"
+		}
+		overlay.lines = append(overlay.lines, fmt.Sprintf(
+			"%s %2d %-8.8s %4s %s",
+			marker,
+			idx+1,
+			commit.Id,
+			shortAge(commit.AuthoredDate, time.Now()),
+			commit.Title,
+		))
+	}
+
+	return overlay
+}
+
+// Switches to reviewing m.commits[idx] on its own, or the whole MR for -1.
+func (m Model) showCommit(idx int) (tea.Model, tea.Cmd) {
+	if idx < 0 {
+		return m.showWholeMR()
+	}
+
+	commit := m.commits[idx]
+	gl, pid, vp, refs := m.gl, m.initData.project, *m.viewParams(0), m.mr.DiffRefs
+
+	// Copied here since the MR's regions may change while the commit loads
+	mrFiles := make(map[string]*FileRegion)
+	mrComments := make(map[string][]Comment)
+	for _, region := range m.mrRegionList() {
+		if fr, ok := region.(*FileRegion); ok {
+			mrFiles[fr.newPath] = fr
+			mrComments[fr.newPath] = append([]Comment(nil), fr.comments...)
+		}
+	}
+
+	return m.doBlockingLoad(fmt.Sprintf("Loading commit %s...", commit.ShortId), func() tea.Msg {
+		return loadCommit(gl, pid, &commit, refs, mrFiles, mrComments, vp)
+	})
+}
+
+// Builds regions for the changes commit made, with the MR's comments on them
+// where they can be positioned.
+func loadCommit(gl *GLInstance, pid string, commit *GLCommit, mrRefs GLDiffRefs, mrFiles map[string]*FileRegion, mrComments map[string][]Comment, vp ViewParams) CommitLoadedMsg {
+	msg := CommitLoadedMsg{commit: commit}
+
+	details, err := gl.FetchCommit(pid, commit.Id)
+	if err != nil {
+		msg.err = err
+		return msg
+	}
+	commit.ParentIds = details.ParentIds
+
+	changes, err := gl.FetchCommitDiff(pid, commit.Id)
+	if err != nil {
+		msg.err = err
+		return msg
+	}
+
+	// Same as a version of the file in the MR's diff, which side is found by
+	// whichever path and ref are given
+	sameAs := func(path string, ref string, mrPath string, mrRef string) bool {
+		content, err := fetchFileContents(gl, pid, path, ref)
+		if err != nil {
+			return false
+		}
+		mrContent, err := fetchFileContents(gl, pid, mrPath, mrRef)
+		return err == nil && content == mrContent
+	}
+
+	msg.regions = make([]VRegion, len(changes))
+	mrData := &GLMRData{Changes: changes, DiffRefs: commit.diffRefs()}
+	for loaded := range loadFileRegions(gl, pid, mrData, vp) {
+		if loaded.err != nil {
+			msg.regions[loaded.idx] = &PlaceholderRegion{path: changes[loaded.idx].NewPath, err: loaded.err}
+			continue
+		}
+
+		fr := loaded.region.(*FileRegion)
+		cf := &commitFile{commit: commit, mrFile: mrFiles[fr.newPath]}
+		if cf.mrFile != nil {
+			mr := cf.mrFile
+			cf.headMatches = !fr.removed && !mr.removed &&
+				sameAs(fr.newPath, commit.Id, mr.newPath, mrRefs.HeadSHA)
+			cf.baseMatches = !fr.added && !mr.added &&
+				sameAs(fr.oldPath, commit.diffRefs().BaseSHA, mr.oldPath, mrRefs.BaseSHA)
+		}
+
+		fr.inCommit = cf
+		fr.comments = mrComments[fr.newPath]
+		vp.lineNoColWidth = fr.lineNoColWidth
+		fr.updateLineMap(&vp)
+		msg.regions[loaded.idx] = fr
+	}
+
+	return msg
+}
+
+func (m Model) applyCommit(msg CommitLoadedMsg) (tea.Model, tea.Cmd) {
+	if msg.err != nil {
+		log.Error().Err(msg.err).Str("sha", msg.commit.Id).Msg("Unable to load commit.")
+		return m.displayStatusMessage(fmt.Sprintf("ERR: Unable to load commit %s: %s.", msg.commit.ShortId, msg.err), 3*time.Second)
+	}
+
+	if m.viewedCommit == nil {
+		m.mrRegions = m.regions
+		m.mrCursor = m.anchorCursor()
+	}
+	m.regions = msg.regions
+	m.viewedCommit = msg.commit
+	m.selection = nil
+	m.cursor, m.x, m.y = 0, 0, 0
+	(&m).relayout()
+
+	cmds := []tea.Cmd{m.detectMoves(m.regions)}
+	var files []*FileRegion
+	for _, region := range m.regions {
+		if fr, ok := region.(*FileRegion); ok {
+			files = append(files, fr)
+		}
+	}
+	if m.diffOpts.Active() {
+		cmds = append(cmds, m.rebuildDiffs(files, m.diffOpts))
+	}
+	if m.settings.blame {
+		cmds = append(cmds, m.loadBlame(files))
+	}
+
+	next, statusCmd := m.displayStatusMessage(
+		fmt.Sprintf("Commit %d of %d: %s", m.viewedCommitIdx()+1, len(m.commits), msg.commit.Title),
+		5*time.Second,
+	)
+	return next, tea.Batch(append(cmds, statusCmd)...)
+}
+
+// Goes back to the MR's diff, with the cursor where it was left.
+func (m Model) showWholeMR() (tea.Model, tea.Cmd) {
+	return m.returnToMR("Showing the whole MR.")
+}
+
+// Goes back to the MR's diff as showWholeMR does, telling the user status.
+func (m Model) returnToMR(status string) (tea.Model, tea.Cmd) {
+	if m.viewedCommit == nil {
+		return m.displayStatusMessage(status, 3*time.Second)
+	}
+
+	m.regions = m.mrRegions
+	m.mrRegions = nil
+	m.viewedCommit = nil
+	m.selection = nil
+	m.cursor, m.x, m.y = 0, 0, 0
+	for _, region := range m.regions {
+		region.Resize(&m)
+	}
+	(&m).restoreCursor(m.mrCursor)
+	(&m).clampCursor()
+
+	// Settings may have changed while the commit was shown
+	var cmds []tea.Cmd
+	var files, stale []*FileRegion
+	for _, region := range m.regions {
+		if fr, ok := region.(*FileRegion); ok {
+			files = append(files, fr)
+			if m.diffOpts.Active() || fr.serverFF != nil {
+				stale = append(stale, fr)
+			}
+		}
+	}
+	if len(stale) > 0 {
+		cmds = append(cmds, m.rebuildDiffs(stale, m.diffOpts))
+	}
+	if m.settings.blame {
+		cmds = append(cmds, m.loadBlame(files))
+	}
+
+	next, statusCmd := m.displayStatusMessage(status, 3*time.Second)
+	return next, tea.Batch(append(cmds, statusCmd)...)
+}
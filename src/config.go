@@ -1,55 +1,564 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"github.com/alecthomas/chroma/styles"
 	gloss "github.com/charmbracelet/lipgloss"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type GLIMRRFileConfigColors struct {
 	Background string
+
+	// Diff line backgrounds, with and without the cursor on them
+	Unchanged       string
+	Added           string
+	Removed         string
+	CursorUnchanged string
+	CursorAdded     string
+	CursorRemoved   string
+
+	// Backgrounds of lines which were moved rather than changed
+	MovedAdded         string
+	MovedRemoved       string
+	CursorMovedAdded   string
+	CursorMovedRemoved string
+
+	Header       string
+	CursorHeader string
+	HeaderText   string
+
+	// The line under a scrolled file's header naming the enclosing scope
+	Scope     string
+	ScopeText string
+
+	// Whitespace markers, and the background of trailing whitespace
+	Whitespace         string
+	TrailingWhitespace string
+
+	// Text of the blame gutter
+	Blame string
+
+	Note             string
+	CursorNote       string
+	NoteBorder       string
+	CursorNoteBorder string
+	NoteRule         string
+}
+
+type GLIMRRFileConfigContext struct {
+	// Unchanged lines kept visible either side of a change
+	Lines int
+	// How many unchanged lines in a row it takes before any are hidden
+	Threshold int
+	// Hidden lines revealed at a time when expanding them bit by bit
+	Expand int
+}
+
+type GLIMRRFileConfigWhitespace struct {
+	// Columns between tab stops
+	TabWidth int
+	// Tab widths for particular languages, keyed by chroma lexer name (e.g.
+	// "Go" or "Makefile"). .editorconfig files in LocalClone take precedence.
+	TabWidths map[string]int
+	// Which whitespace to draw markers on: none, trailing or all
+	Show string
+}
+
+type GLIMRRFileConfigBehavior struct {
+	// How often to poll for new discussions, as a Go duration string. "0"
+	// disables polling.
+	RefreshInterval string
+	// Size limit of the on-disk HTTP cache, in megabytes
+	CacheSizeMB int
+	// Scroll and click with the mouse. Off by default, since selecting text
+	// then needs shift held down in most terminals.
+	Mouse bool
+}
+
+type GLIMRRFileConfigDiff struct {
+	// One of gitlab, myers, patience or histogram. Anything but gitlab means
+	// diffs are computed locally rather than taken from GitLab.
+	Algorithm string
+	// Show code which was moved, within a file or between them, differently
+	// to code which was changed
+	DetectMoves bool
+}
+
+// Credentials for a single GitLab host. Either Token or TokenCommand (a shell
+// command which prints the token, e.g. `pass show gitlab`) should be set.
+type GLIMRRFileConfigHost struct {
+	Token        string
+	TokenCommand string
+	OAuth        bool
 }
 
 type GLIMRRFileConfig struct {
 	Colors GLIMRRFileConfigColors
+	// Name of a chroma style, see https://xyproto.github.io/splash/docs/
+	SyntaxStyle string
+	Context     GLIMRRFileConfigContext
+	// Number of files fetched and formatted concurrently
+	Workers int
+	// Command used to write comments, defaults to $EDITOR
+	Editor string
+	// Soft-wrap lines too long for the terminal rather than cutting them off
+	Wrap bool
+	// Show who last changed each unchanged or removed line, and when
+	Blame      bool
+	Whitespace GLIMRRFileConfigWhitespace
+	Behavior   GLIMRRFileConfigBehavior
+	Diff       GLIMRRFileConfigDiff
+	// Path to a clone of the project. Files are read from it rather than
+	// GitLab when it has the commits needed. Usually set under Projects.
+	LocalClone string
+	// Action name to the keys which trigger it. Actions listed here replace
+	// the default keys for that action, unlisted actions keep their defaults.
+	Keys map[string][]string
+	// Keyed by hostname, e.g. "gitlab.com"
+	Hosts map[string]GLIMRRFileConfigHost
+	// Keyed by project path, e.g. "group/project". Each value is a partial
+	// config which is applied on top of the rest of the file.
+	Projects map[string]json.RawMessage
 }
 
 type GLIMRRConfigColors struct {
 	Background gloss.Color
+	// Indexed by a line's Mode, or'd with 4 when the cursor is on it
+	LineBackgrounds [7]gloss.Color
+	// The same for moved lines, only the added and removed entries are used
+	MovedBackgrounds [7]gloss.Color
+
+	Header       gloss.Color
+	CursorHeader gloss.Color
+	HeaderText   gloss.Color
+
+	Scope     gloss.Color
+	ScopeText gloss.Color
+
+	Whitespace         gloss.Color
+	TrailingWhitespace gloss.Color
+
+	Blame gloss.Color
+
+	Note             gloss.Color
+	CursorNote       gloss.Color
+	NoteBorder       gloss.Color
+	CursorNoteBorder gloss.Color
+	NoteRule         gloss.Color
+}
+
+type GLIMRRConfigContext struct {
+	Lines     int
+	Threshold int
+	Expand    int
+}
+
+type GLIMRRConfigWhitespace struct {
+	TabWidth  int
+	TabWidths map[string]int
+	Show      string
+}
+
+type GLIMRRConfigBehavior struct {
+	RefreshInterval time.Duration
+	CacheMaxBytes   int64
+	Mouse           bool
+}
+
+type GLIMRRConfigDiff struct {
+	Algorithm   string
+	DetectMoves bool
+}
+
+type GLIMRRConfigHost struct {
+	Token        string
+	TokenCommand string
+	OAuth        bool
 }
 
 type GLIMRRConfig struct {
-	Colors GLIMRRConfigColors
+	Colors      GLIMRRConfigColors
+	SyntaxStyle string
+	Context     GLIMRRConfigContext
+	Workers     int
+	Editor      string
+	Wrap        bool
+	Blame       bool
+	Whitespace  GLIMRRConfigWhitespace
+	Behavior    GLIMRRConfigBehavior
+	Diff        GLIMRRConfigDiff
+	LocalClone  string
+	Keys        map[string][]string
+	Hosts       map[string]GLIMRRConfigHost
+
+	// Keys, parsed and grouped by action context
+	bindings map[string][]keyBinding
+}
+
+// All of the problems found in a config file, so they can be fixed in one go.
+type ConfigError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid config in %s:\n  %s", e.Path, strings.Join(e.Problems, "\n  "))
+}
+
+var colorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+func validateColor(name string, value string, problems *[]string) gloss.Color {
+	if !colorPattern.MatchString(value) {
+		ansi, err := strconv.Atoi(value)
+		if err != nil || ansi < 0 || ansi > 255 {
+			*problems = append(*problems, fmt.Sprintf(
+				"Colors.%s: %q is neither a hex colour (#RGB/#RRGGBB) nor an ANSI colour number",
+				name,
+				value,
+			))
+		}
+	}
+
+	return gloss.Color(value)
 }
 
-func fileConfigToConfig(f GLIMRRFileConfig) *GLIMRRConfig {
+func fileConfigToConfig(f GLIMRRFileConfig) (*GLIMRRConfig, []string) {
+	var problems []string
+	c := f.Colors
+
+	refreshInterval, err := time.ParseDuration(f.Behavior.RefreshInterval)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Behavior.RefreshInterval: %s", err))
+	}
+
+	if f.Behavior.CacheSizeMB < 0 {
+		problems = append(problems, "Behavior.CacheSizeMB: must not be negative")
+	}
+
+	if _, ok := styles.Registry[f.SyntaxStyle]; !ok {
+		var names []string
+		for name := range styles.Registry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		problems = append(problems, fmt.Sprintf(
+			"SyntaxStyle: unknown style %q, expected one of %s",
+			f.SyntaxStyle,
+			strings.Join(names, ", "),
+		))
+	}
+
+	if f.Context.Lines < 0 {
+		problems = append(problems, "Context.Lines: must not be negative")
+	}
+	if f.Context.Threshold <= f.Context.Lines {
+		problems = append(problems, "Context.Threshold: must be greater than Context.Lines")
+	}
+	if f.Context.Expand < 1 {
+		problems = append(problems, "Context.Expand: must be at least 1")
+	}
+
+	validAlgorithm := false
+	for _, algorithm := range diffAlgorithms {
+		validAlgorithm = validAlgorithm || f.Diff.Algorithm == algorithm
+	}
+	if !validAlgorithm {
+		problems = append(problems, fmt.Sprintf(
+			"Diff.Algorithm: unknown algorithm %q, expected one of %s",
+			f.Diff.Algorithm,
+			strings.Join(diffAlgorithms, ", "),
+		))
+	}
+
+	if f.Whitespace.TabWidth < 1 {
+		problems = append(problems, "Whitespace.TabWidth: must be at least 1")
+	}
+	for _, language := range sortedKeys(f.Whitespace.TabWidths) {
+		if f.Whitespace.TabWidths[language] < 1 {
+			problems = append(problems, fmt.Sprintf("Whitespace.TabWidths.%s: must be at least 1", language))
+		}
+	}
+
+	validShow := false
+	for _, mode := range whitespaceModes {
+		validShow = validShow || f.Whitespace.Show == mode
+	}
+	if !validShow {
+		problems = append(problems, fmt.Sprintf(
+			"Whitespace.Show: unknown setting %q, expected one of %s",
+			f.Whitespace.Show,
+			strings.Join(whitespaceModes, ", "),
+		))
+	}
+
+	if f.Workers < 1 {
+		problems = append(problems, "Workers: must be at least 1")
+	}
+
+	bindings, keyProblems := buildBindings(f.Keys)
+	problems = append(problems, keyProblems...)
+
+	hosts := make(map[string]GLIMRRConfigHost)
+	for host, hostCfg := range f.Hosts {
+		if hostCfg.Token != "" && hostCfg.TokenCommand != "" {
+			problems = append(problems, fmt.Sprintf("Hosts.%s: only one of Token and TokenCommand may be set", host))
+		}
+		hosts[host] = GLIMRRConfigHost(hostCfg)
+	}
+
 	return &GLIMRRConfig{
 		Colors: GLIMRRConfigColors{
-			Background: gloss.Color(f.Colors.Background),
+			Background: validateColor("Background", c.Background, &problems),
+			LineBackgrounds: [7]gloss.Color{
+				validateColor("Unchanged", c.Unchanged, &problems),
+				validateColor("Added", c.Added, &problems),
+				validateColor("Removed", c.Removed, &problems),
+				gloss.Color(c.Background),
+				validateColor("CursorUnchanged", c.CursorUnchanged, &problems),
+				validateColor("CursorAdded", c.CursorAdded, &problems),
+				validateColor("CursorRemoved", c.CursorRemoved, &problems),
+			},
+			MovedBackgrounds: [7]gloss.Color{
+				gloss.Color(c.Unchanged),
+				validateColor("MovedAdded", c.MovedAdded, &problems),
+				validateColor("MovedRemoved", c.MovedRemoved, &problems),
+				gloss.Color(c.Background),
+				gloss.Color(c.CursorUnchanged),
+				validateColor("CursorMovedAdded", c.CursorMovedAdded, &problems),
+				validateColor("CursorMovedRemoved", c.CursorMovedRemoved, &problems),
+			},
+			Header:             validateColor("Header", c.Header, &problems),
+			CursorHeader:       validateColor("CursorHeader", c.CursorHeader, &problems),
+			HeaderText:         validateColor("HeaderText", c.HeaderText, &problems),
+			Scope:              validateColor("Scope", c.Scope, &problems),
+			ScopeText:          validateColor("ScopeText", c.ScopeText, &problems),
+			Whitespace:         validateColor("Whitespace", c.Whitespace, &problems),
+			TrailingWhitespace: validateColor("TrailingWhitespace", c.TrailingWhitespace, &problems),
+			Blame:              validateColor("Blame", c.Blame, &problems),
+			Note:               validateColor("Note", c.Note, &problems),
+			CursorNote:         validateColor("CursorNote", c.CursorNote, &problems),
+			NoteBorder:         validateColor("NoteBorder", c.NoteBorder, &problems),
+			CursorNoteBorder:   validateColor("CursorNoteBorder", c.CursorNoteBorder, &problems),
+			NoteRule:           validateColor("NoteRule", c.NoteRule, &problems),
+		},
+		SyntaxStyle: f.SyntaxStyle,
+		Context: GLIMRRConfigContext{
+			Lines:     f.Context.Lines,
+			Threshold: f.Context.Threshold,
+			Expand:    f.Context.Expand,
+		},
+		Workers: f.Workers,
+		Editor:  f.Editor,
+		Wrap:    f.Wrap,
+		Blame:   f.Blame,
+		Whitespace: GLIMRRConfigWhitespace{
+			TabWidth:  f.Whitespace.TabWidth,
+			TabWidths: f.Whitespace.TabWidths,
+			Show:      f.Whitespace.Show,
 		},
+		Behavior: GLIMRRConfigBehavior{
+			RefreshInterval: refreshInterval,
+			CacheMaxBytes:   int64(f.Behavior.CacheSizeMB) * 1024 * 1024,
+			Mouse:           f.Behavior.Mouse,
+		},
+		Diff: GLIMRRConfigDiff{
+			Algorithm:   f.Diff.Algorithm,
+			DetectMoves: f.Diff.DetectMoves,
+		},
+		LocalClone: expandHome(f.LocalClone),
+		Keys:       f.Keys,
+		Hosts:      hosts,
+		bindings:   bindings,
+	}, problems
+}
+
+// Expands a leading ~/ to the user's home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, path[2:])
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+
+	return keys
 }
 
-func loadConfigFromFile(path string) (*GLIMRRConfig, error) {
-	config := defaultFileConfig
+// Decodes data over config, rejecting fields we don't know about since
+// they're almost certainly typos.
+func decodeConfigStrict(data []byte, config *GLIMRRFileConfig) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(config)
+}
+
+// Loads the config at path, applying the overrides for project if there are
+// any. If the file doesn't exist the defaults are returned along with the
+// error from reading it. Any other problem is reported as a *ConfigError.
+func loadConfigFromFile(path string, project string) (*GLIMRRConfig, error) {
+	config := newDefaultFileConfig()
+	defaultConfig, _ := fileConfigToConfig(newDefaultFileConfig())
 
 	data, err := os.ReadFile(path)
 	if nil != err {
-		return fileConfigToConfig(defaultFileConfig), err
+		return defaultConfig, err
 	}
 
-	err = json.Unmarshal(data, &config)
+	// Keys are per action, so decode them separately and merge them over the
+	// defaults rather than letting a partial map replace the whole thing.
+	userKeys := make(map[string][]string)
+	mergeKeys := func() {
+		for action, keys := range config.Keys {
+			userKeys[action] = keys
+		}
+		config.Keys = nil
+	}
+
+	config.Keys = nil
+	err = decodeConfigStrict(data, &config)
 	if nil != err {
-		return fileConfigToConfig(defaultFileConfig), err
+		return defaultConfig, &ConfigError{Path: path, Problems: []string{err.Error()}}
+	}
+	mergeKeys()
+
+	if override, ok := config.Projects[project]; ok {
+		err = decodeConfigStrict(override, &config)
+		if nil != err {
+			return defaultConfig, &ConfigError{
+				Path:     path,
+				Problems: []string{fmt.Sprintf("Projects.%s: %s", project, err)},
+			}
+		}
+		mergeKeys()
+	}
+
+	config.Keys = newDefaultFileConfig().Keys
+	for action, keys := range userKeys {
+		config.Keys[action] = keys
+	}
+
+	cfg, problems := fileConfigToConfig(config)
+	if len(problems) > 0 {
+		return defaultConfig, &ConfigError{Path: path, Problems: problems}
+	}
+
+	return cfg, nil
+}
+
+// Builds the command to open the user's editor on the given arguments.
+func (c *GLIMRRConfig) EditorCommand(args ...string) *exec.Cmd {
+	parts := c.editorParts()
+	return exec.Command(parts[0], append(parts[1:], args...)...)
+}
+
+// Builds the command to open the user's editor on path at line. Most editors
+// take +N for this, VS Code has a flag of its own.
+func (c *GLIMRRConfig) EditorCommandAt(path string, line int) *exec.Cmd {
+	parts := c.editorParts()
+
+	var args []string
+	switch filepath.Base(parts[0]) {
+	case "code", "code-insiders", "codium":
+		args = []string{"--goto", fmt.Sprintf("%s:%d", path, line)}
+	default:
+		args = []string{fmt.Sprintf("+%d", line), path}
 	}
 
-	return fileConfigToConfig(config), nil
+	return exec.Command(parts[0], append(parts[1:], args...)...)
 }
 
-var defaultFileConfig = GLIMRRFileConfig{
-	Colors: GLIMRRFileConfigColors{
-		Background: "#000",
-	},
+func (c *GLIMRRConfig) editorParts() []string {
+	// Allow things like "code --wait"
+	parts := strings.Fields(c.Editor)
+	if len(parts) == 0 {
+		parts = strings.Fields(os.Getenv("EDITOR"))
+	}
+	if len(parts) == 0 {
+		parts = []string{"vi"}
+	}
+
+	return parts
+}
+
+func newDefaultFileConfig() GLIMRRFileConfig {
+	keys := make(map[string][]string)
+	for _, spec := range actionSpecs {
+		if len(spec.keys) > 0 {
+			keys[spec.name] = append([]string(nil), spec.keys...)
+		}
+	}
+
+	return GLIMRRFileConfig{
+		Colors: GLIMRRFileConfigColors{
+			Background:         "#000",
+			Unchanged:          "#000",
+			Added:              "#040",
+			Removed:            "#400",
+			CursorUnchanged:    "#444",
+			CursorAdded:        "#474",
+			CursorRemoved:      "#744",
+			MovedAdded:         "#035",
+			MovedRemoved:       "#305",
+			CursorMovedAdded:   "#368",
+			CursorMovedRemoved: "#638",
+			Header:             "#b9c902",
+			CursorHeader:       "#ebfc2b",
+			HeaderText:         "#000",
+			Scope:              "#222",
+			ScopeText:          "#b9c902",
+			Whitespace:         "#666",
+			TrailingWhitespace: "#a22",
+			Blame:              "#888",
+			Note:               "#444",
+			CursorNote:         "#666",
+			NoteBorder:         "#FFF",
+			CursorNoteBorder:   "#AF0",
+			NoteRule:           "#AAA",
+		},
+		SyntaxStyle: "vim",
+		Context: GLIMRRFileConfigContext{
+			Lines:     5,
+			Threshold: 10,
+			Expand:    10,
+		},
+		Workers: 4,
+		Whitespace: GLIMRRFileConfigWhitespace{
+			TabWidth: 4,
+			Show:     WhitespaceNone,
+		},
+		Behavior: GLIMRRFileConfigBehavior{
+			RefreshInterval: "60s",
+			CacheSizeMB:     256,
+			Mouse:           false,
+		},
+		Diff: GLIMRRFileConfigDiff{
+			Algorithm:   AlgorithmGitLab,
+			DetectMoves: true,
+		},
+		Keys: keys,
+	}
 }
 
-var CFG = fileConfigToConfig(defaultFileConfig)
+var CFG, _ = fileConfigToConfig(newDefaultFileConfig())
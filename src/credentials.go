@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type Credential struct {
+	Token string
+	// OAuth tokens are sent as a bearer token rather than a PRIVATE-TOKEN
+	OAuth bool
+	// Where the token came from, for error messages
+	Source string
+}
+
+// Finds a token for host, trying (in order) the host's entry in the config
+// file, the GLIMRR_TOKEN environment variable, the glab CLI's config and
+// ~/.netrc.
+func ResolveCredential(host string) (*Credential, error) {
+	if hostCfg, ok := CFG.Hosts[host]; ok {
+		if hostCfg.Token != "" {
+			return &Credential{
+				Token:  hostCfg.Token,
+				OAuth:  hostCfg.OAuth,
+				Source: "config",
+			}, nil
+		}
+
+		if hostCfg.TokenCommand != "" {
+			token, err := tokenFromCommand(hostCfg.TokenCommand)
+			if err != nil {
+				return nil, fmt.Errorf("Token command for %s failed: %w", host, err)
+			}
+
+			return &Credential{
+				Token:  token,
+				OAuth:  hostCfg.OAuth,
+				Source: fmt.Sprintf("token command `%s`", hostCfg.TokenCommand),
+			}, nil
+		}
+	}
+
+	if token := os.Getenv("GLIMRR_TOKEN"); token != "" {
+		return &Credential{Token: token, Source: "GLIMRR_TOKEN"}, nil
+	}
+
+	if cred := credentialFromGlab(host); cred != nil {
+		return cred, nil
+	}
+
+	if cred := credentialFromNetrc(host); cred != nil {
+		return cred, nil
+	}
+
+	return nil, fmt.Errorf(
+		"No GitLab token found for %s. Set GLIMRR_TOKEN, add %s to Hosts in your glimrr config, log in with `glab auth login` or add it to ~/.netrc.",
+		host,
+		host,
+	)
+}
+
+func tokenFromCommand(command string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	// Tools like pass put the secret on the first line and metadata after
+	token := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	if token == "" {
+		return "", fmt.Errorf("command produced no output")
+	}
+
+	return token, nil
+}
+
+func glabConfigPath() string {
+	if dir := os.Getenv("GLAB_CONFIG_DIR"); dir != "" {
+		return filepath.Join(dir, "config.yml")
+	}
+
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "glab-cli", "config.yml")
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".config", "glab-cli", "config.yml")
+}
+
+// glab keeps its hosts in a YAML file. We only need a couple of scalar keys
+// out of the hosts section, so rather than pulling in a YAML library this
+// picks them out by indentation.
+func credentialFromGlab(host string) *Credential {
+	path := glabConfigPath()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	inHosts := false
+	hostIndent := -1
+	inHost := false
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if indent == 0 {
+			inHosts = trimmed == "hosts:"
+			inHost = false
+			continue
+		}
+		if !inHosts {
+			continue
+		}
+
+		if hostIndent < 0 || indent <= hostIndent {
+			hostIndent = indent
+			inHost = strings.TrimSuffix(trimmed, ":") == host
+			continue
+		}
+
+		if inHost {
+			key, value, found := strings.Cut(trimmed, ":")
+			if found {
+				values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+			}
+		}
+	}
+
+	if values["token"] == "" {
+		return nil
+	}
+
+	log.Debug().Str("path", path).Msg("Using token from glab config.")
+	return &Credential{
+		Token:  values["token"],
+		OAuth:  values["is_oauth2"] == "true",
+		Source: path,
+	}
+}
+
+func credentialFromNetrc(host string) *Credential {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(homeDir, ".netrc")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	fields := strings.Fields(string(data))
+	inMachine := false
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			i++
+			inMachine = i < len(fields) && fields[i] == host
+		case "default":
+			inMachine = false
+		case "password":
+			i++
+			if inMachine && i < len(fields) {
+				log.Debug().Str("path", path).Msg("Using token from netrc.")
+				return &Credential{Token: fields[i], Source: path}
+			}
+		}
+	}
+
+	return nil
+}
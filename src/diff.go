@@ -0,0 +1,494 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// Use the diff GitLab provides, unless other options call for a local one
+	AlgorithmGitLab    = "gitlab"
+	AlgorithmMyers     = "myers"
+	AlgorithmPatience  = "patience"
+	AlgorithmHistogram = "histogram"
+)
+
+var diffAlgorithms = []string{AlgorithmGitLab, AlgorithmMyers, AlgorithmPatience, AlgorithmHistogram}
+
+// Options for diffs computed locally, rather than taken from GitLab.
+type DiffOptions struct {
+	// One of diffAlgorithms, empty is the same as AlgorithmGitLab
+	Algorithm string
+	// Lines which differ only in whitespace are treated as unchanged
+	IgnoreWhitespace bool
+	// Added and removed blank lines don't count as changes, so they're hidden
+	// away with the unchanged lines
+	IgnoreBlankLines bool
+}
+
+// Whether the options call for a local diff at all.
+func (o DiffOptions) Active() bool {
+	return o.IgnoreWhitespace || o.IgnoreBlankLines || (o.Algorithm != "" && o.Algorithm != AlgorithmGitLab)
+}
+
+// What a line is compared by.
+func (o DiffOptions) key(line string) string {
+	if o.IgnoreWhitespace {
+		return strings.Join(strings.Fields(line), "")
+	}
+
+	return line
+}
+
+// Whether line, as it appears in a diff, is worth drawing attention to.
+func (o DiffOptions) IsChange(line *FormattedLine) bool {
+	if line.mode == UNCHANGED {
+		return false
+	}
+
+	return !o.IgnoreBlankLines || strings.TrimSpace(line.Text()) != ""
+}
+
+type editKind int
+
+const (
+	editKeep editKind = iota
+	editInsert
+	editDelete
+)
+
+// One step in turning a into b. a and b are indices into each side, for
+// inserts a is the position in a the line is inserted before and vice versa
+// for deletes.
+type edit struct {
+	kind editKind
+	a    int
+	b    int
+}
+
+// Finds the shortest edit script between a and b with Myers' O(ND)
+// algorithm, in its linear space form: the middle snake of the shortest path
+// is found by searching from both ends at once, and the parts either side of
+// it are diffed the same way. Very different inputs get a script which may be
+// a little longer than the shortest, see myersMaxCost.
+func myersDiff(a []string, b []string) []edit {
+	path := myersPath(a, b, 0, 0, len(a), len(b))
+	if len(path) == 0 {
+		return nil
+	}
+
+	var edits []edit
+	x, y := path[0][0], path[0][1]
+	keep := func(toX int, toY int) {
+		for x < toX && y < toY && a[x] == b[y] {
+			edits = append(edits, edit{kind: editKeep, a: x, b: y})
+			x++
+			y++
+		}
+	}
+
+	// Each step along the path is at most one insert or delete, with
+	// matching lines either side
+	for _, point := range path[1:] {
+		keep(point[0], point[1])
+		switch {
+		case point[0]-x < point[1]-y:
+			edits = append(edits, edit{kind: editInsert, a: x, b: y})
+			y++
+		case point[0]-x > point[1]-y:
+			edits = append(edits, edit{kind: editDelete, a: x, b: y})
+			x++
+		}
+		keep(point[0], point[1])
+	}
+
+	return edits
+}
+
+// The points the shortest path from (left, top) to (right, bottom) goes
+// through, where x indexes a and y indexes b. Nil for an empty box.
+func myersPath(a []string, b []string, left int, top int, right int, bottom int) [][2]int {
+	start, finish, ok := myersMiddleSnake(a, b, left, top, right, bottom)
+	if !ok {
+		return nil
+	}
+
+	head := myersPath(a, b, left, top, start[0], start[1])
+	tail := myersPath(a, b, finish[0], finish[1], right, bottom)
+	if head == nil {
+		head = [][2]int{start}
+	}
+	if tail == nil {
+		tail = [][2]int{finish}
+	}
+
+	return append(head, tail...)
+}
+
+// How far the search for a middle snake goes before settling for a path
+// which may not be the shortest, so big files which have been rewritten don't
+// take seconds to diff.
+func myersMaxCost(size int) int {
+	cost := 1
+	for cost*cost < size {
+		cost++
+	}
+
+	return Max(cost, 256)
+}
+
+// Finds the middle snake of the shortest path across the box, by following
+// the furthest reaching paths forwards from the top left and backwards from
+// the bottom right until they overlap. Returns the points either end of the
+// snake.
+func myersMiddleSnake(a []string, b []string, left int, top int, right int, bottom int) (start [2]int, finish [2]int, ok bool) {
+	width, height := right-left, bottom-top
+	size := width + height
+	if size == 0 {
+		return start, finish, false
+	}
+
+	delta := width - height
+	limit := (size + 1) / 2
+	offset := limit + 1
+	// The furthest x reached forwards on each diagonal k, and the furthest y
+	// reached backwards on each diagonal c, counted from the bottom right
+	vf := make([]int, 2*offset+1)
+	vb := make([]int, 2*offset+1)
+	vf[offset+1] = left
+	vb[offset+1] = bottom
+
+	for d := 0; d <= limit; d++ {
+		for k := d; k >= -d; k -= 2 {
+			var x, px int
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+				px = x
+			} else {
+				px = vf[offset+k-1]
+				x = px + 1
+			}
+
+			y := top + (x - left) - k
+			py := y
+			if d != 0 && x == px {
+				py = y - 1
+			}
+			for x < right && y < bottom && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[offset+k] = x
+
+			c := k - delta
+			if delta%2 != 0 && c >= -(d-1) && c <= d-1 && y >= vb[offset+c] {
+				return [2]int{px, py}, [2]int{x, y}, true
+			}
+		}
+
+		for c := d; c >= -d; c -= 2 {
+			var y, py int
+			if c == -d || (c != d && vb[offset+c-1] > vb[offset+c+1]) {
+				y = vb[offset+c+1]
+				py = y
+			} else {
+				py = vb[offset+c-1]
+				y = py - 1
+			}
+
+			k := c + delta
+			x := left + (y - top) + k
+			px := x
+			if d != 0 && y == py {
+				px = x + 1
+			}
+			for x > left && y > top && a[x-1] == b[y-1] {
+				x--
+				y--
+			}
+			vb[offset+c] = y
+
+			if delta%2 == 0 && k >= -d && k <= d && x <= vf[offset+k] {
+				return [2]int{x, y}, [2]int{px, py}, true
+			}
+		}
+
+		// Past this point an exact answer costs too much time, so split
+		// at whichever forward path has got furthest instead, as git does
+		if d >= myersMaxCost(size) {
+			best := [2]int{left, top}
+			for k := d; k >= -d; k -= 2 {
+				// Paths on diagonals which leave the box can't be used
+				x := vf[offset+k]
+				y := top + (x - left) - k
+				if x <= right && y <= bottom && x+y > best[0]+best[1] {
+					best = [2]int{x, y}
+				}
+			}
+
+			return best, best, true
+		}
+	}
+
+	return start, finish, false
+}
+
+// Diffs a and b with the given algorithm, falling back to Myers.
+func diffKeys(a []string, b []string, algorithm string) []edit {
+	var edits []edit
+
+	switch algorithm {
+	case AlgorithmPatience:
+		diffAnchored(a, b, 0, 0, patienceAnchors, &edits)
+	case AlgorithmHistogram:
+		diffAnchored(a, b, 0, 0, histogramAnchors, &edits)
+	default:
+		edits = myersDiff(a, b)
+	}
+
+	return edits
+}
+
+// Picks lines which are known to match between a and b, as pairs of indices in
+// increasing order on both sides. Returning none means Myers should be used.
+type anchorFunc func(a []string, b []string) [][2]int
+
+// Splits the diff of a and b around the anchors chosen by anchorsOf, then
+// diffs the gaps between them the same way. aOff and bOff are where a and b
+// start in the whole file, for the indices in the edits.
+func diffAnchored(a []string, b []string, aOff int, bOff int, anchorsOf anchorFunc, edits *[]edit) {
+	// Common ends are matched whatever happens, so get them out of the way
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		*edits = append(*edits, edit{kind: editKeep, a: aOff + prefix, b: bOff + prefix})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	aStart, bStart := aOff+prefix, bOff+prefix
+
+	anchors := anchorsOf(midA, midB)
+	if len(anchors) == 0 {
+		for _, e := range myersDiff(midA, midB) {
+			*edits = append(*edits, edit{kind: e.kind, a: aStart + e.a, b: bStart + e.b})
+		}
+	} else {
+		lastA, lastB := 0, 0
+		for _, anchor := range anchors {
+			diffAnchored(midA[lastA:anchor[0]], midB[lastB:anchor[1]], aStart+lastA, bStart+lastB, anchorsOf, edits)
+			*edits = append(*edits, edit{kind: editKeep, a: aStart + anchor[0], b: bStart + anchor[1]})
+			lastA, lastB = anchor[0]+1, anchor[1]+1
+		}
+		diffAnchored(midA[lastA:], midB[lastB:], aStart+lastA, bStart+lastB, anchorsOf, edits)
+	}
+
+	for i := suffix; i > 0; i-- {
+		*edits = append(*edits, edit{kind: editKeep, a: aOff + len(a) - i, b: bOff + len(b) - i})
+	}
+}
+
+// Patience diff anchors on lines which appear exactly once on each side,
+// taking the longest run of them which is in the same order on both.
+func patienceAnchors(a []string, b []string) [][2]int {
+	type occurrence struct {
+		countA, countB int
+		idxA, idxB     int
+	}
+	occurrences := make(map[string]*occurrence)
+	for idx, line := range a {
+		o, ok := occurrences[line]
+		if !ok {
+			o = &occurrence{}
+			occurrences[line] = o
+		}
+		o.countA++
+		o.idxA = idx
+	}
+	for idx, line := range b {
+		if o, ok := occurrences[line]; ok {
+			o.countB++
+			o.idxB = idx
+		}
+	}
+
+	// Unique pairs in the order they appear in a
+	var pairs [][2]int
+	for idx, line := range a {
+		o := occurrences[line]
+		if o.countA == 1 && o.countB == 1 {
+			pairs = append(pairs, [2]int{idx, o.idxB})
+		}
+	}
+
+	return longestIncreasing(pairs)
+}
+
+// The longest subsequence of pairs (already increasing in a) which is also
+// increasing in b, by patience sorting.
+func longestIncreasing(pairs [][2]int) [][2]int {
+	var tops []int
+	prev := make([]int, len(pairs))
+
+	for idx, pair := range pairs {
+		pile := sort.Search(len(tops), func(i int) bool {
+			return pairs[tops[i]][1] > pair[1]
+		})
+
+		prev[idx] = -1
+		if pile > 0 {
+			prev[idx] = tops[pile-1]
+		}
+
+		if pile == len(tops) {
+			tops = append(tops, idx)
+		} else {
+			tops[pile] = idx
+		}
+	}
+
+	if len(tops) == 0 {
+		return nil
+	}
+
+	result := make([][2]int, len(tops))
+	for idx, i := tops[len(tops)-1], len(tops)-1; i >= 0; idx, i = prev[idx], i-1 {
+		result[i] = pairs[idx]
+	}
+
+	return result
+}
+
+// Above this many occurrences a line is too common to be a useful anchor.
+const histogramMaxOccurrences = 64
+
+// Histogram diff, as in git, anchors on the longest block of matching lines
+// around the least frequent line in a which also appears in b. This copes
+// better than patience with files which have few unique lines.
+func histogramAnchors(a []string, b []string) [][2]int {
+	positions := make(map[string][]int)
+	for idx, line := range a {
+		positions[line] = append(positions[line], idx)
+		if len(positions[line]) > histogramMaxOccurrences {
+			return nil
+		}
+	}
+
+	found := false
+	bestA, bestB, bestLen := 0, 0, 0
+	bestCount := histogramMaxOccurrences
+	for bPtr := 0; bPtr < len(b); {
+		bNext := bPtr + 1
+
+		occurrences := positions[b[bPtr]]
+		for i := 0; i < len(occurrences) && len(occurrences) <= bestCount; {
+			as, bs := occurrences[i], bPtr
+			ae, be := as, bs
+			// The rarest line in the block decides how good an anchor it is
+			count := len(occurrences)
+
+			for as > 0 && bs > 0 && a[as-1] == b[bs-1] {
+				as--
+				bs--
+				count = Min(count, len(positions[a[as]]))
+			}
+			for ae+1 < len(a) && be+1 < len(b) && a[ae+1] == b[be+1] {
+				ae++
+				be++
+				count = Min(count, len(positions[a[ae]]))
+			}
+
+			bNext = Max(bNext, be+1)
+			if !found || bestLen < ae-as+1 || count < bestCount {
+				found = true
+				bestA, bestB, bestLen = as, bs, ae-as+1
+				bestCount = count
+			}
+
+			// Occurrences within the block would only find it again
+			for i < len(occurrences) && occurrences[i] <= ae {
+				i++
+			}
+		}
+
+		bPtr = bNext
+	}
+
+	if !found {
+		return nil
+	}
+
+	anchors := make([][2]int, bestLen)
+	for i := range anchors {
+		anchors[i] = [2]int{bestA + i, bestB + i}
+	}
+
+	return anchors
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// Added to the key of a file's last line when it has no newline after it, so
+// adding or removing the newline changes the line as it does in GitLab's
+// diffs. Ignoring whitespace ignores that too.
+const noNewlineKey = "\x00no newline"
+
+// What each of lines, split from s, is compared by.
+func (o DiffOptions) keys(s string, lines []string) []string {
+	keys := make([]string, len(lines))
+	for idx, line := range lines {
+		keys[idx] = o.key(line)
+	}
+	if len(keys) > 0 && !o.IgnoreWhitespace && !strings.HasSuffix(s, "\n") {
+		keys[len(keys)-1] += noNewlineKey
+	}
+
+	return keys
+}
+
+// Diffs base against head in process. Lines the options consider equal are
+// shown as they are in head.
+func DiffContents(base string, head string, opts DiffOptions) *DiffFile {
+	baseLines := splitLines(base)
+	headLines := splitLines(head)
+	baseKeys := opts.keys(base, baseLines)
+	headKeys := opts.keys(head, headLines)
+
+	var df DiffFile
+	for _, e := range diffKeys(baseKeys, headKeys, opts.Algorithm) {
+		switch e.kind {
+		case editKeep:
+			df.lines = append(df.lines, &DiffLine{
+				text: headLines[e.b],
+				mode: UNCHANGED,
+				aNum: e.a + 1,
+				bNum: e.b + 1,
+			})
+		case editInsert:
+			df.lines = append(df.lines, &DiffLine{
+				text: headLines[e.b],
+				mode: ADDED,
+				aNum: e.a + 1,
+				bNum: e.b + 1,
+			})
+		case editDelete:
+			df.lines = append(df.lines, &DiffLine{
+				text: baseLines[e.a],
+				mode: REMOVED,
+				aNum: e.a + 1,
+				bNum: e.b + 1,
+			})
+		}
+	}
+
+	return &df
+}
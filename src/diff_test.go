@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Shows an edit script as one character per edit, ' ' for lines kept, '-' for
+// deletes and '+' for inserts.
+func editString(edits []edit) string {
+	var b strings.Builder
+	for _, e := range edits {
+		b.WriteByte(" +-"[e.kind])
+	}
+
+	return b.String()
+}
+
+// Checks edits turns a into b, with each edit at the right place on both
+// sides, and returns how many lines it inserts and deletes.
+func checkEdits(t *testing.T, a []string, b []string, edits []edit) int {
+	t.Helper()
+
+	x, y, cost := 0, 0, 0
+	for _, e := range edits {
+		if e.a != x || e.b != y {
+			t.Fatalf("Edit %+v at (%d, %d) in %q", e, x, y, editString(edits))
+		}
+
+		switch e.kind {
+		case editKeep:
+			if a[x] != b[y] {
+				t.Fatalf("Kept %q as %q in %q", a[x], b[y], editString(edits))
+			}
+			x++
+			y++
+		case editInsert:
+			y++
+			cost++
+		case editDelete:
+			x++
+			cost++
+		}
+	}
+
+	if x != len(a) || y != len(b) {
+		t.Fatalf("Edits %q stop at (%d, %d), not (%d, %d)", editString(edits), x, y, len(a), len(b))
+	}
+
+	return cost
+}
+
+func TestMyersDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{"both empty", "", "", ""},
+		{"all inserted", "", "abc", "+++"},
+		{"all deleted", "abc", "", "---"},
+		{"same", "abc", "abc", "   "},
+		{"insert in the middle", "ac", "abc", " + "},
+		{"delete in the middle", "abc", "ac", " - "},
+		{"replace", "abc", "axc", " -+ "},
+		{"total rewrite", "abc", "xyz", "---+++"},
+		{"paper example", "abcabba", "cbabac", "-- - +  +"},
+		{"repeated lines", "aaab", "aab", "  - "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := strings.Split(tt.a, ""), strings.Split(tt.b, "")
+			edits := myersDiff(a, b)
+			checkEdits(t, a, b, edits)
+			if got := editString(edits); got != tt.want {
+				t.Errorf("myersDiff(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func lcsLength(a []string, b []string) int {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = Max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+
+	return lengths[0][0]
+}
+
+// Every algorithm must give a valid script, and Myers the shortest one.
+func TestDiffKeysRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	lines := func() []string {
+		out := make([]string, r.Intn(16))
+		for i := range out {
+			out[i] = string(rune('a' + r.Intn(4)))
+		}
+		return out
+	}
+
+	for i := 0; i < 5000; i++ {
+		a, b := lines(), lines()
+		shortest := len(a) + len(b) - 2*lcsLength(a, b)
+
+		for _, algorithm := range []string{AlgorithmMyers, AlgorithmPatience, AlgorithmHistogram} {
+			cost := checkEdits(t, a, b, diffKeys(a, b, algorithm))
+			if algorithm == AlgorithmMyers && cost != shortest {
+				t.Fatalf("myersDiff(%q, %q) costs %d, want %d", a, b, cost, shortest)
+			}
+		}
+	}
+}
+
+// Inputs too different for an exact answer must still get a valid script.
+func TestMyersDiffPastMaxCost(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	a, b := make([]string, 2000), make([]string, 2000)
+	for i := range a {
+		a[i] = fmt.Sprint(r.Intn(50))
+		b[i] = fmt.Sprint(r.Intn(50))
+	}
+
+	shortest := len(a) + len(b) - 2*lcsLength(a, b)
+	if shortest <= myersMaxCost(len(a)+len(b)) {
+		t.Fatalf("Inputs only differ by %d lines, not enough to test with", shortest)
+	}
+	if cost := checkEdits(t, a, b, myersDiff(a, b)); cost < shortest {
+		t.Errorf("myersDiff() costs %d, less than the shortest %d", cost, shortest)
+	}
+}
+
+func TestPatienceAnchors(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want [][2]int
+	}{
+		{"nothing unique", "aab", "abb", nil},
+		{"unique lines", "xay", "xby", [][2]int{{0, 0}, {2, 2}}},
+		{"repeated lines skipped", "xaay", "xay", [][2]int{{0, 0}, {3, 2}}},
+		{"longest in order", "abcd", "bacd", [][2]int{{1, 0}, {2, 2}, {3, 3}}},
+		{"only unique on one side", "ab", "bb", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := patienceAnchors(strings.Split(tt.a, ""), strings.Split(tt.b, ""))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patienceAnchors(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramAnchors(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want [][2]int
+	}{
+		{"nothing in common", []string{"a"}, []string{"b"}, nil},
+		{"rarest line", []string{"x", "a", "x"}, []string{"a", "x"}, [][2]int{{1, 0}, {2, 1}}},
+		{
+			"block around the rarest line",
+			[]string{"}", "a", "b", "}", "}"},
+			[]string{"}", "}", "a", "b", "}"},
+			[][2]int{{0, 1}, {1, 2}, {2, 3}, {3, 4}},
+		},
+		{
+			"too common",
+			strings.Split(strings.Repeat("a", histogramMaxOccurrences+1), ""),
+			[]string{"a"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := histogramAnchors(tt.a, tt.b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("histogramAnchors(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// Which lines on each side of a diff are changed.
+type changedLines struct {
+	base []bool
+	head []bool
+}
+
+// Reads which lines git marked as changed in a diff with the whole file as
+// context, as written by testdata/diff/generate.sh.
+func readGitDiff(t *testing.T, path string, baseLen int, headLen int) changedLines {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	changed := changedLines{base: make([]bool, baseLen), head: make([]bool, headLen)}
+	inHunk := false
+	a, b := 0, 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "@@") {
+			inHunk = true
+			continue
+		}
+		if !inHunk || line == "" {
+			continue
+		}
+
+		switch line[0] {
+		case ' ':
+			a++
+			b++
+		case '-':
+			changed.base[a] = true
+			a++
+		case '+':
+			changed.head[b] = true
+			b++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return changed
+}
+
+// Slides every run of changed lines as far down as it goes. A run can move
+// down a line when the line after it is the same as its first line, so two
+// diffs which only differ in where they put such runs end up the same.
+func slideDown(changed []bool, lines []string) []bool {
+	slid := append([]bool(nil), changed...)
+	for moved := true; moved; {
+		moved = false
+		for start := 0; start < len(slid); start++ {
+			if !slid[start] || (start > 0 && slid[start-1]) {
+				continue
+			}
+
+			end := start
+			for end < len(slid) && slid[end] {
+				end++
+			}
+			if end < len(slid) && lines[start] == lines[end] {
+				slid[start], slid[end] = false, true
+				moved = true
+			}
+		}
+	}
+
+	return slid
+}
+
+// Shows changed as a line of '.'s and '*'s, for failure messages.
+func changedString(changed []bool) string {
+	var b strings.Builder
+	for _, c := range changed {
+		if c {
+			b.WriteByte('*')
+		} else {
+			b.WriteByte('.')
+		}
+	}
+
+	return b.String()
+}
+
+func TestDiffContentsMatchesGit(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "diff", "*", "base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("No cases in testdata/diff")
+	}
+
+	for _, basePath := range dirs {
+		dir := filepath.Dir(basePath)
+		base, err := os.ReadFile(basePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, err := os.ReadFile(filepath.Join(dir, "head"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		baseLines, headLines := splitLines(string(base)), splitLines(string(head))
+
+		for _, algorithm := range []string{AlgorithmMyers, AlgorithmPatience, AlgorithmHistogram} {
+			t.Run(fmt.Sprintf("%s/%s", filepath.Base(dir), algorithm), func(t *testing.T) {
+				df := DiffContents(string(base), string(head), DiffOptions{Algorithm: algorithm})
+
+				gotBase, gotHead := ReconstituteDiff(df)
+				if gotBase != strings.Join(baseLines, "\n")+strings.Repeat("\n", Min(len(baseLines), 1)) ||
+					gotHead != strings.Join(headLines, "\n")+strings.Repeat("\n", Min(len(headLines), 1)) {
+					t.Fatalf("Diff doesn't rebuild the files, got base %q and head %q", gotBase, gotHead)
+				}
+
+				got := changedLines{base: make([]bool, len(baseLines)), head: make([]bool, len(headLines))}
+				for _, line := range df.lines {
+					switch line.mode {
+					case REMOVED:
+						got.base[line.aNum-1] = true
+					case ADDED:
+						got.head[line.bNum-1] = true
+					}
+				}
+				want := readGitDiff(t, filepath.Join(dir, algorithm+".diff"), len(baseLines), len(headLines))
+
+				for _, side := range []struct {
+					name      string
+					lines     []string
+					got, want []bool
+				}{
+					{"base", baseLines, got.base, want.base},
+					{"head", headLines, got.head, want.head},
+				} {
+					gotSlid, wantSlid := slideDown(side.got, side.lines), slideDown(side.want, side.lines)
+					if !reflect.DeepEqual(gotSlid, wantSlid) {
+						t.Errorf(
+							"Changed %s lines\n got %s\nwant %s",
+							side.name,
+							changedString(gotSlid),
+							changedString(wantSlid),
+						)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Whitespace options are applied to the comparison, not the text shown.
+func TestDiffContentsOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		base string
+		head string
+		opts DiffOptions
+		want string
+	}{
+		{"missing newline added", "a\nb", "a\nb\n", DiffOptions{}, " -+"},
+		{"missing newline ignored with whitespace", "a\nb", "a\nb\n", DiffOptions{IgnoreWhitespace: true}, "  "},
+		{"indentation", "if x {\n\ty()\n}\n", "if x {\n    y()\n}\n", DiffOptions{}, " -+ "},
+		{"indentation ignored", "if x {\n\ty()\n}\n", "if x {\n    y()\n}\n", DiffOptions{IgnoreWhitespace: true}, "   "},
+		{"empty base", "", "a\n", DiffOptions{}, "+"},
+		{"empty head", "a\n", "", DiffOptions{}, "-"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			for _, line := range DiffContents(tt.base, tt.head, tt.opts).lines {
+				b.WriteByte(map[Mode]byte{UNCHANGED: ' ', REMOVED: '-', ADDED: '+'}[line.mode])
+			}
+
+			if got := b.String(); got != tt.want {
+				t.Errorf("DiffContents(%q, %q) = %q, want %q", tt.base, tt.head, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"github.com/alecthomas/chroma"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// One [glob] section of an .editorconfig file.
+type editorConfigSection struct {
+	pattern    *regexp.Regexp
+	properties map[string]string
+}
+
+type editorConfig struct {
+	// Set when parent directories' files shouldn't be consulted
+	root     bool
+	sections []editorConfigSection
+}
+
+// Parsed .editorconfig files by path, nil where there isn't one.
+var editorConfigCache = struct {
+	sync.Mutex
+	entries map[string]*editorConfig
+}{entries: make(map[string]*editorConfig)}
+
+// Works out the tab width for a file, from .editorconfig files in the local
+// clone if there are any which say, then the width configured for its
+// language and lastly the general setting.
+func tabWidthFor(path string, lexer chroma.Lexer) int {
+	if CFG.LocalClone != "" {
+		if width, ok := editorConfigTabWidth(CFG.LocalClone, path); ok {
+			return width
+		}
+	}
+
+	if lexer != nil {
+		for language, width := range CFG.Whitespace.TabWidths {
+			if strings.EqualFold(language, lexer.Config().Name) {
+				return width
+			}
+		}
+	}
+
+	return CFG.Whitespace.TabWidth
+}
+
+// Looks up the tab width .editorconfig files under root give path, which is
+// relative to root. Files closer to path win, as do later sections within a
+// file.
+func editorConfigTabWidth(root string, path string) (int, bool) {
+	properties := make(map[string]string)
+
+	dir := filepath.Dir(filepath.Clean(path))
+	for {
+		ec := loadEditorConfig(filepath.Join(root, dir, ".editorconfig"))
+		if ec != nil {
+			rel, err := filepath.Rel(dir, path)
+			if err == nil {
+				for idx := len(ec.sections) - 1; idx >= 0; idx-- {
+					section := ec.sections[idx]
+					if !section.pattern.MatchString(filepath.ToSlash(rel)) {
+						continue
+					}
+					for key, value := range section.properties {
+						if _, ok := properties[key]; !ok {
+							properties[key] = value
+						}
+					}
+				}
+			}
+
+			if ec.root {
+				break
+			}
+		}
+
+		if dir == "." || dir == string(filepath.Separator) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	if width, err := strconv.Atoi(properties["tab_width"]); err == nil && width > 0 {
+		return width, true
+	}
+	// indent_size implies tab_width unless it's "tab", which defers to it
+	if width, err := strconv.Atoi(properties["indent_size"]); err == nil && width > 0 {
+		return width, true
+	}
+
+	return 0, false
+}
+
+func loadEditorConfig(path string) *editorConfig {
+	editorConfigCache.Lock()
+	ec, ok := editorConfigCache.entries[path]
+	editorConfigCache.Unlock()
+	if ok {
+		return ec
+	}
+
+	ec = parseEditorConfig(path)
+
+	editorConfigCache.Lock()
+	editorConfigCache.entries[path] = ec
+	editorConfigCache.Unlock()
+
+	return ec
+}
+
+func parseEditorConfig(path string) *editorConfig {
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("path", path).Msg("Unable to read .editorconfig.")
+		}
+		return nil
+	}
+	defer file.Close()
+
+	ec := &editorConfig{}
+	// Index of the section being read, -1 before the first one
+	section := -1
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			pattern, err := regexp.Compile(editorConfigGlob(line[1 : len(line)-1]))
+			if err != nil {
+				log.Warn().Err(err).Str("path", path).Str("section", line).Msg("Skipping bad .editorconfig section.")
+				section = -1
+				continue
+			}
+
+			ec.sections = append(ec.sections, editorConfigSection{
+				pattern:    pattern,
+				properties: make(map[string]string),
+			})
+			section = len(ec.sections) - 1
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.ToLower(strings.TrimSpace(value))
+
+		if section >= 0 {
+			ec.sections[section].properties[key] = value
+		} else if key == "root" {
+			ec.root = value == "true"
+		}
+	}
+
+	return ec
+}
+
+var numericRange = regexp.MustCompile(`^\{-?\d+\.\.-?\d+\}$`)
+
+// Translates an .editorconfig section glob into a regexp matched against
+// paths relative to the file. Globs without a slash match files of that name
+// in any directory. Numeric ranges ({1..3}) match any number.
+func editorConfigGlob(glob string) string {
+	var b strings.Builder
+
+	if strings.Contains(glob, "/") {
+		glob = strings.TrimPrefix(glob, "/")
+	} else {
+		b.WriteString("(?:.*/)?")
+	}
+
+	braces := 0
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case r == '*' && i+1 < len(runes) && runes[i+1] == '*':
+			i++
+			b.WriteString(".*")
+		case r == '*':
+			b.WriteString("[^/]*")
+		case r == '?':
+			b.WriteString("[^/]")
+		case r == '[':
+			end := indexRuneFrom(runes, i, ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := string(runes[i+1 : end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		case r == '{':
+			end := indexRuneFrom(runes, i, '}')
+			if end >= 0 && numericRange.MatchString(string(runes[i:end+1])) {
+				b.WriteString(`-?\d+`)
+				i = end
+				continue
+			}
+			braces++
+			b.WriteString("(?:")
+		case r == '}' && braces > 0:
+			braces--
+			b.WriteString(")")
+		case r == ',' && braces > 0:
+			b.WriteString("|")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	// Close any unbalanced braces so the pattern still compiles
+	for ; braces > 0; braces-- {
+		b.WriteString(")")
+	}
+
+	return "^" + b.String() + "$"
+}
+
+// The index of the first r in runes at or after from, or -1.
+func indexRuneFrom(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+
+	return -1
+}
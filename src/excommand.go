@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const maxHistoryEntries = 500
+
+// The words of an ex command. Words are separated by unquoted whitespace,
+// single quotes take everything literally, double quotes and bare words allow
+// backslash escapes.
+type exTokens struct {
+	words []string
+	// The input ended inside a quote
+	quoteOpen bool
+	// The input ended partway through a word, rather than after whitespace
+	endsInWord bool
+}
+
+func tokenizeEx(input string) exTokens {
+	var t exTokens
+	var word strings.Builder
+	inWord := false
+	escaped := false
+	var quote rune
+
+	for _, r := range input {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				t.words = append(t.words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		t.words = append(t.words, word.String())
+	}
+	t.quoteOpen = quote != 0
+	t.endsInWord = inWord
+
+	return t
+}
+
+// Splits an ex command into its words, see tokenizeEx.
+func parseExCommand(input string) ([]string, error) {
+	t := tokenizeEx(input)
+	if t.quoteOpen {
+		return nil, fmt.Errorf("Unterminated quote")
+	}
+
+	return t.words, nil
+}
+
+// Quotes word if it wouldn't survive tokenizeEx as it is.
+func quoteExArg(word string) string {
+	if word != "" && !strings.ContainsAny(word, " \t'\"\\") {
+		return word
+	}
+
+	return "'" + strings.ReplaceAll(word, "'", `'"'"'`) + "'"
+}
+
+func allCommands() []string {
+	var commands []string
+	for _, spec := range actionSpecs {
+		commands = append(commands, spec.commands...)
+	}
+	sort.Strings(commands)
+
+	return commands
+}
+
+// The capitals of a command name, lowercased, e.g. "ca" for CollapseAll.
+func commandInitials(command string) string {
+	var initials strings.Builder
+	for _, r := range command {
+		if unicode.IsUpper(r) {
+			initials.WriteRune(unicode.ToLower(r))
+		}
+	}
+
+	return initials.String()
+}
+
+// Finds the action for a command, which may be given in full, as an
+// unambiguous prefix (case insensitive) or by its initials.
+func resolveCommand(name string) (*actionSpec, error) {
+	if spec := lookupCommand(name); spec != nil {
+		return spec, nil
+	}
+
+	lower := strings.ToLower(name)
+	var matches []string
+	var spec *actionSpec
+	seen := make(map[*actionSpec]bool)
+	for _, command := range allCommands() {
+		if strings.HasPrefix(strings.ToLower(command), lower) || commandInitials(command) == lower {
+			spec = lookupCommand(command)
+			if !seen[spec] {
+				matches = append(matches, command)
+				seen[spec] = true
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("Unrecognized command %q", name)
+	case 1:
+		return spec, nil
+	}
+
+	return nil, fmt.Errorf("Ambiguous command %q, could be %s", name, strings.Join(matches, ", "))
+}
+
+// Candidates for the arguments of commands which take them, keyed by action.
+var argCompleters = map[string]func(m Model) []string{
+	"goto_file": func(m Model) []string {
+		return m.changedPaths()
+	},
+	"set_algorithm": func(m Model) []string {
+		return diffAlgorithms
+	},
+	"ignore_whitespace": func(m Model) []string {
+		return []string{"blank"}
+	},
+	"show_whitespace": func(m Model) []string {
+		return whitespaceModes
+	},
+	"goto_commit": func(m Model) []string {
+		candidates := []string{"all"}
+		for _, commit := range m.commits {
+			candidates = append(candidates, commit.ShortId)
+		}
+		return candidates
+	},
+}
+
+func (m Model) changedPaths() []string {
+	var paths []string
+	for _, change := range m.mr.Changes {
+		paths = append(paths, change.NewPath)
+		if change.OldPath != change.NewPath {
+			paths = append(paths, change.OldPath)
+		}
+	}
+
+	return paths
+}
+
+// Finds the index of the change for path, which can be either side of a
+// rename. A unique suffix or substring of a path is also accepted.
+func (m Model) findChange(path string) (int, error) {
+	matchers := []func(candidate string) bool{
+		func(candidate string) bool { return candidate == path },
+		func(candidate string) bool { return strings.HasSuffix(candidate, path) },
+		func(candidate string) bool { return strings.Contains(candidate, path) },
+	}
+
+	for _, matches := range matchers {
+		found := -1
+		ambiguous := false
+		for idx, change := range m.mr.Changes {
+			if matches(change.NewPath) || matches(change.OldPath) {
+				ambiguous = ambiguous || found >= 0
+				found = idx
+			}
+		}
+
+		if ambiguous {
+			return 0, fmt.Errorf("%q matches more than one file", path)
+		}
+		if found >= 0 {
+			return found, nil
+		}
+	}
+
+	return 0, fmt.Errorf("No changed file matches %q", path)
+}
+
+// Tab completion state, kept while the user cycles through candidates.
+type exCompletion struct {
+	// The input before the word being completed
+	prefix     string
+	candidates []string
+	idx        int
+	// What the input was set to, so we can tell if the user has typed since
+	value string
+}
+
+func filterCandidates(candidates []string, partial string) []string {
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(partial)) {
+			matches = append(matches, candidate)
+		}
+	}
+
+	// Paths are long, so fall back to matching anywhere in them
+	if len(matches) == 0 {
+		for _, candidate := range candidates {
+			if strings.Contains(strings.ToLower(candidate), strings.ToLower(partial)) {
+				matches = append(matches, candidate)
+			}
+		}
+	}
+
+	return matches
+}
+
+// Works out the completions for the word under the cursor at the end of
+// input. Returns nil if there's nothing to complete.
+func (m Model) completeEx(input string) *exCompletion {
+	t := tokenizeEx(input)
+
+	partial := ""
+	done := t.words
+	if t.endsInWord || t.quoteOpen {
+		partial = t.words[len(t.words)-1]
+		done = t.words[:len(t.words)-1]
+	}
+
+	var candidates []string
+	if len(done) == 0 {
+		candidates = filterCandidates(allCommands(), partial)
+	} else {
+		spec, err := resolveCommand(done[0])
+		if err != nil {
+			return nil
+		}
+		completer, ok := argCompleters[spec.name]
+		if !ok {
+			return nil
+		}
+		candidates = filterCandidates(completer(m), partial)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var prefix strings.Builder
+	for _, word := range done {
+		prefix.WriteString(quoteExArg(word))
+		prefix.WriteString(" ")
+	}
+
+	return &exCompletion{prefix: prefix.String(), candidates: candidates, idx: -1}
+}
+
+// Moves to the next (or with a negative step, previous) candidate and returns
+// the input which results.
+func (c *exCompletion) advance(step int) string {
+	c.idx = (c.idx + step + len(c.candidates)) % len(c.candidates)
+	c.value = c.prefix + quoteExArg(c.candidates[c.idx])
+
+	return c.value
+}
+
+// Ex commands run in previous sessions, oldest first.
+type exHistory struct {
+	path    string
+	entries []string
+	// Position while browsing with up/down, len(entries) when not browsing
+	pos int
+	// What was typed before browsing started. Only entries starting with it
+	// are visited.
+	draft string
+}
+
+func historyPath() string {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		stateDir = filepath.Join(homeDir, ".local", "state")
+	}
+
+	return filepath.Join(stateDir, "glimrr", "history")
+}
+
+func loadExHistory() *exHistory {
+	h := &exHistory{path: historyPath()}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("path", h.path).Msg("Unable to read command history.")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.entries = append(h.entries, line)
+		}
+	}
+
+	h.entries = h.entries[Max(len(h.entries)-maxHistoryEntries, 0):]
+	h.pos = len(h.entries)
+
+	return h
+}
+
+func (h *exHistory) Add(entry string) {
+	h.pos = len(h.entries)
+	if entry == "" || (len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry) {
+		return
+	}
+
+	h.entries = append(h.entries, entry)
+	h.entries = h.entries[Max(len(h.entries)-maxHistoryEntries, 0):]
+	h.pos = len(h.entries)
+
+	if h.path == "" {
+		return
+	}
+
+	err := os.MkdirAll(filepath.Dir(h.path), 0o700)
+	if err == nil {
+		err = os.WriteFile(h.path, []byte(strings.Join(h.entries, "\n")+"\n"), 0o600)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("path", h.path).Msg("Unable to save command history.")
+	}
+}
+
+// Steps through the history, returning the entry to show. Stepping past the
+// newest entry gives back what was typed before browsing began.
+func (h *exHistory) Step(direction int, current string) string {
+	if h.pos == len(h.entries) {
+		h.draft = current
+	}
+
+	for pos := h.pos + direction; pos >= 0 && pos <= len(h.entries); pos += direction {
+		if pos == len(h.entries) {
+			h.pos = pos
+			return h.draft
+		}
+		if strings.HasPrefix(h.entries[pos], h.draft) {
+			h.pos = pos
+			return h.entries[pos]
+		}
+	}
+
+	return current
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// What the cursor is on, in terms other tools understand.
+type cursorLocation struct {
+	region *FileRegion
+	// nil on a file's header
+	line *FormattedLine
+	// Set when the cursor is on a comment
+	note *GLNote
+}
+
+func (m Model) cursorLocation() (cursorLocation, bool) {
+	if len(m.regions) == 0 {
+		return cursorLocation{}, false
+	}
+
+	region, relCursor := m.getCursorTarget(m.cursor)
+	fr, ok := region.(*FileRegion)
+	if !ok {
+		return cursorLocation{}, false
+	}
+
+	anchor := fr.GetAnchor(relCursor)
+	loc := cursorLocation{region: fr, line: anchor.line}
+	loc.note, _ = anchor.comment.(*GLNote)
+
+	return loc, true
+}
+
+// Whether loc only exists on the base side: removed lines, and everything in
+// deleted files. Everything else is shown as it is in head.
+func (l cursorLocation) onBase() bool {
+	return l.region.removed || (l.line != nil && l.line.mode == REMOVED)
+}
+
+// loc's line number on the base side or the head side. Lines which don't
+// exist on that side give the number of the line before them there.
+func (l cursorLocation) lineNoOn(base bool) int {
+	if l.line == nil {
+		return 0
+	}
+
+	switch {
+	case base && l.line.mode == ADDED:
+		return l.line.aNum - 1
+	case base:
+		return l.line.aNum
+	case l.line.mode == REMOVED:
+		return l.line.bNum - 1
+	}
+
+	return l.line.bNum
+}
+
+// The file, revision and line number loc refers to.
+func (l cursorLocation) revision(refs GLDiffRefs) (path string, ref string, lineNo int) {
+	if l.onBase() {
+		path, ref = l.region.oldPath, refs.BaseSHA
+	} else {
+		path, ref = l.region.newPath, refs.HeadSHA
+	}
+
+	return path, ref, Max(l.lineNoOn(l.onBase()), 1)
+}
+
+// The MR's page on GitLab.
+func (m Model) mrURL() string {
+	return fmt.Sprintf("%s/%s/-/merge_requests/%d", m.initData.glHost, m.initData.project, m.mr.Iid)
+}
+
+// Where loc can be seen on GitLab: the note itself for comments which have
+// been posted, otherwise the line in the MR's diff, or the commit's.
+func (m Model) webURL(loc cursorLocation) string {
+	if loc.note != nil && !loc.note.IsPending() {
+		return fmt.Sprintf("%s#note_%d", m.mrURL(), loc.note.Id)
+	}
+
+	diffURL := m.mrURL() + "/diffs"
+	if loc.region.inCommit != nil {
+		diffURL = fmt.Sprintf("%s/%s/-/commit/%s", m.initData.glHost, m.initData.project, loc.region.inCommit.commit.Id)
+	}
+
+	// GitLab identifies files in diffs by a hash of their path, and lines by
+	// that plus the line number on each side
+	fileHash := fmt.Sprintf("%x", sha1.Sum([]byte(loc.region.newPath)))
+	if loc.line == nil {
+		return fmt.Sprintf("%s#%s", diffURL, fileHash)
+	}
+
+	return fmt.Sprintf("%s#%s_%d_%d", diffURL, fileHash, loc.line.aNum, loc.line.bNum)
+}
+
+// Opens the file under the cursor in the user's editor at the cursor's line.
+// The local clone's copy is used if it has the right commit checked out,
+// otherwise the file is fetched into a temporary file.
+func (m Model) openInEditor() (tea.Model, tea.Cmd) {
+	loc, ok := m.cursorLocation()
+	if !ok {
+		return m, nil
+	}
+
+	path, ref, lineNo := loc.revision(m.refsOf(loc.region))
+	fullPath, ok := localCheckoutPath(path, ref)
+	if !ok {
+		content, err := fetchFileContents(m.gl, m.initData.project, path, ref)
+		if err != nil {
+			return m.displayStatusMessage(fmt.Sprintf("ERR: Unable to fetch %s.", path), 3*time.Second)
+		}
+
+		// Keep the name so the editor can tell what kind of file it is
+		tmpFile, err := os.CreateTemp("", "glimrr-*-"+filepath.Base(path))
+		if err == nil {
+			_, err = tmpFile.WriteString(content)
+			tmpFile.Close()
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to write file to open in editor.")
+			return m.displayStatusMessage("ERR: Unable to create a temporary file.", 3*time.Second)
+		}
+
+		fullPath = tmpFile.Name()
+		defer os.Remove(fullPath)
+		// It's a snapshot, so make it clear edits won't go anywhere
+		os.Chmod(fullPath, 0o444)
+	}
+
+	log.Debug().Msg("Assuming control of terminal from tea")
+	m.p.ReleaseTerminal()
+
+	cmd := CFG.EditorCommandAt(fullPath, lineNo)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	err := cmd.Run()
+
+	log.Debug().Msg("Restoring control of terminal to tea")
+	m.p.RestoreTerminal()
+
+	if err != nil {
+		log.Error().Err(err).Msg("Editor exited unsuccessfully.")
+		return m.displayStatusMessage(fmt.Sprintf("ERR: Editor failed: %s.", err), 3*time.Second)
+	}
+
+	return m, nil
+}
+
+// Opens the GitLab page for whatever's under the cursor in a browser.
+func (m Model) openInBrowser() (tea.Model, tea.Cmd) {
+	loc, ok := m.cursorLocation()
+	if !ok {
+		return m, nil
+	}
+
+	url := m.webURL(loc)
+	if err := openURL(url); err != nil {
+		log.Error().Err(err).Str("url", url).Msg("Unable to open browser.")
+		return m.displayStatusMessage(fmt.Sprintf("ERR: Unable to open browser: %s.", err), 3*time.Second)
+	}
+
+	return m.displayStatusMessage(fmt.Sprintf("Opened %s", url), 3*time.Second)
+}
+
+// Opens url with $BROWSER, or the system's opener if that isn't set.
+func openURL(url string) error {
+	opener := os.Getenv("BROWSER")
+	if opener == "" {
+		opener = "xdg-open"
+		if runtime.GOOS == "darwin" {
+			opener = "open"
+		}
+	}
+
+	cmd := exec.Command(opener, url)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Browsers often stay running, so don't hold anything up waiting
+	go cmd.Wait()
+
+	return nil
+}
@@ -6,8 +6,8 @@ import (
 	gloss "github.com/charmbracelet/lipgloss"
 	"github.com/rs/zerolog/log"
 	"os"
-	"os/exec"
 	"strings"
+	"time"
 )
 
 const NUM_FR_TYPES = 5
@@ -34,11 +34,29 @@ type Comment interface {
 	GetPosition() CommentPosition
 }
 
+// Identifies the object under a cursor position independently of the current
+// line layout, so the cursor can be put back after the layout changes.
+type Anchor struct {
+	objType int
+	// For comments this is the line the comment hangs off of, used as a
+	// fallback should the comment go away.
+	line    *FormattedLine
+	comment Comment
+}
+
 type abridgement struct {
 	start int
 	end   int
 }
 
+// Which version of a file is shown in full, without abridgements. Only lines
+// from that side of the diff are shown, with changes marked in the gutter.
+const (
+	fullViewOff = iota
+	fullViewHead
+	fullViewBase
+)
+
 type FileRegion struct {
 	ff             *FormattedFile
 	oldPath        string
@@ -50,138 +68,162 @@ type FileRegion struct {
 	abrs           []abridgement
 	comments       []Comment
 	lineNoColWidth int
+	// Columns between tab stops, see tabWidthFor
+	tabWidth int
+	// Whether the whole file is shown rather than just the changes, one of
+	// the fullView constants
+	fullView int
+	// The commit which last changed each line of the base version, by line
+	// number less one. nil until loaded, see loadBlame.
+	blame []*GLCommit
+	// Set when the region shows one commit's changes rather than the MR's
+	inCommit *commitFile
+	// GitLab's diff for the file, kept while one computed locally is shown
+	serverFF *FormattedFile
 }
 
-func (f *FileRegion) Update(m *Model, msg tea.Msg, cursor int) (tea.Model, tea.Cmd) {
+func (f *FileRegion) HandleAction(m *Model, action string, cursor int) (tea.Model, tea.Cmd) {
 	objIdx, objType := DivMod(f.lineMap[cursor], NUM_FR_TYPES)
-	vp := &ViewParams{
-		x:              0,
-		width:          m.w,
-		lineNoColWidth: f.lineNoColWidth,
-	}
-
-	switch msg := msg.(type) {
-	case tea.KeyMsg:
-		switch msg.String() {
-		case "enter":
-			if objType == FRAbr {
-				f.abrs = append(f.abrs[:objIdx], f.abrs[objIdx+1:]...)
-				f.updateLineMap(vp)
-			} else if objType == FRHeader {
-				f.collapsed = !f.collapsed
-			}
-
-		case "t":
-			f.collapsed = !f.collapsed
-		case "d":
-			if objType != FRComment {
-				return m, nil
-			}
+	vp := m.viewParams(f.lineNoColWidth)
 
-			return m.doBlockingLoad("Deleting comment...", func() tea.Msg {
-				comment := f.comments[objIdx]
-				if !comment.IsPending() {
-					m.gl.DeleteComment(comment, m.mr)
-					m.gl.InvalidateCache()
-				}
-
-				f.comments = append(f.comments[:objIdx], f.comments[objIdx+1:]...)
-				f.updateLineMap(vp)
+	switch action {
+	case "expand_abridgement":
+		if objType == FRAbr {
+			f.revealLines(objIdx, len(f.ff.lines), 0, vp)
+		}
 
-				return nil
-			})
+	case "expand_context", "reveal_top", "reveal_bottom":
+		if objType != FRAbr {
+			return m, nil
+		}
 
-		case "c":
-			if objType != FRLine {
-				return m, nil
-			}
+		top, bottom := CFG.Context.Expand, CFG.Context.Expand
+		if action == "reveal_top" {
+			bottom = 0
+		} else if action == "reveal_bottom" {
+			top = 0
+		}
 
-			log.Debug().Msg("Creating temp file for comment")
-			tmpFile, err := os.CreateTemp("", "new-comment-*.md")
-			if err != nil {
-				log.Fatal().
-					Err(err).
-					Msg("Unable to open file for creating a new comment.")
-				panic("Unable to open file for creating a new comment.")
-			}
+		// Keep the cursor on the abridgement so it can be expanded again
+		m.cursor += f.revealLines(objIdx, top, bottom, vp)
+		m.y = Max(m.y, m.cursor-m.viewHeight()+1)
 
-			fname := tmpFile.Name()
-			defer os.Remove(fname)
+	case "expand_scope":
+		if objType != FRAbr {
+			return m, nil
+		}
 
-			log.Debug().Msg("Assuming control of terminal from tea")
-			m.p.ReleaseTerminal()
+		top, bottom, ok := f.enclosingScope(objIdx)
+		if !ok {
+			return m.displayStatusMessage("No enclosing scope to expand to.", 3*time.Second)
+		}
 
-			editor := os.Getenv("EDITOR")
-			if editor == "" {
-				editor = "vi"
-			}
+		m.cursor += f.revealLines(objIdx, top, bottom, vp)
+		m.y = Max(m.y, m.cursor-m.viewHeight()+1)
+
+	case "header_toggle", "toggle_file":
+		f.collapsed = !f.collapsed
+		// Keep the cursor in this file rather than wherever it lands
+		m.cursor -= cursor
+		m.clampCursor()
+	case "full_file":
+		anchor := m.anchorCursor()
+		shown := f.CycleFullView(vp)
+		m.restoreCursor(anchor)
+		m.clampCursor()
+
+		return m.displayStatusMessage(fmt.Sprintf("Showing %s.", shown), 3*time.Second)
+	case "delete_comment":
+		if objType != FRComment {
+			return m, nil
+		}
 
-			log.Debug().Msg("Invoking editor")
-			cmd := exec.Command(editor, fname)
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Run()
+		return m.deleteComment(f, f.comments[objIdx])
 
-			log.Debug().Msg("Control returned from editor process, reading result")
-			commentBody, err := os.ReadFile(fname)
+	case "new_comment":
+		if objType != FRLine {
+			return m, nil
+		}
 
-			if err != nil {
-				log.Error().
-					Err(err).
-					Msg("Unable to read comment temp file!")
-				return m, nil
+		oldLineNo, newLineNo := f.commentLines(f.ff.lines[objIdx])
+		if f.inCommit != nil {
+			var ok bool
+			oldLineNo, newLineNo, ok = f.inCommit.mrLines(oldLineNo, newLineNo)
+			if !ok {
+				return m.displayStatusMessage(
+					"ERR: This line isn't in the MR's diff, comment on it when viewing the whole MR.",
+					3*time.Second,
+				)
 			}
-			log.Debug().
-				Str("body", string(commentBody)).
-				Msg("Successfully collected comment.")
+		}
+
+		log.Debug().Msg("Creating temp file for comment")
+		tmpFile, err := os.CreateTemp("", "new-comment-*.md")
+		if err != nil {
+			log.Fatal().
+				Err(err).
+				Msg("Unable to open file for creating a new comment.")
+			panic("Unable to open file for creating a new comment.")
+		}
 
-			line := f.ff.lines[objIdx]
-			var oldLineNo int
-			var newLineNo int
+		fname := tmpFile.Name()
+		defer os.Remove(fname)
 
-			if line.mode != ADDED {
-				oldLineNo = line.aNum
-			}
+		log.Debug().Msg("Assuming control of terminal from tea")
+		m.p.ReleaseTerminal()
 
-			if line.mode != REMOVED {
-				newLineNo = line.bNum
-			}
+		log.Debug().Msg("Invoking editor")
+		cmd := CFG.EditorCommand(fname)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Run()
 
-			draftNote := GLNote{
-				Id:   -1,
-				Type: "DiffNote",
-				Body: string(commentBody),
-				Author: GLAuthor{
-					Id:       -1,
-					Name:     "(you)",
-					Username: "(you)",
-				},
-				Position: GLPosition{
-					PositionType: "text",
-					OldPath:      f.oldPath,
-					NewPath:      f.newPath,
-					OldLine:      oldLineNo,
-					NewLine:      newLineNo,
-				},
-			}
-			f.comments = append(f.comments, &draftNote)
-			f.updateLineMap(vp)
+		log.Debug().Msg("Control returned from editor process, reading result")
+		commentBody, err := os.ReadFile(fname)
 
-			log.Debug().Msg("Restoring control of terminal to tea")
-			m.p.RestoreTerminal()
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Unable to read comment temp file!")
 			return m, nil
 		}
+		log.Debug().
+			Str("body", string(commentBody)).
+			Msg("Successfully collected comment.")
+
+		draftNote := GLNote{
+			Id:   -1,
+			Type: "DiffNote",
+			Body: string(commentBody),
+			Author: GLAuthor{
+				Id:       -1,
+				Name:     "(you)",
+				Username: "(you)",
+			},
+			Position: GLPosition{
+				PositionType: "text",
+				OldPath:      f.oldPath,
+				NewPath:      f.newPath,
+				OldLine:      oldLineNo,
+				NewLine:      newLineNo,
+			},
+		}
+		f.comments = append(f.comments, &draftNote)
+		f.updateLineMap(vp)
+		if f.inCommit != nil {
+			f.inCommit.addComment(&draftNote)
+		}
+
+		log.Debug().Msg("Restoring control of terminal to tea")
+		m.p.RestoreTerminal()
+		return m, nil
 	}
 
 	return m, nil
 }
 
 func (f *FileRegion) View(startLine int, numLines int, cursor int, m *Model) string {
-	vp := &ViewParams{
-		x:              0,
-		width:          m.w,
-		lineNoColWidth: f.lineNoColWidth,
-	}
+	vp := m.viewParams(f.lineNoColWidth)
 
 	if numLines < 1 {
 		return ""
@@ -200,110 +242,305 @@ func (f *FileRegion) View(startLine int, numLines int, cursor int, m *Model) str
 	} else if f.removed {
 		modeString = " [DELETED]"
 	}
+	if f.inCommit != nil {
+		modeString += fmt.Sprintf(" [%.8s]", f.inCommit.commit.Id)
+	}
 
-	headerBg := gloss.Color("#b9c902")
+	headerBg := CFG.Colors.Header
 	if cursor == 0 {
-		headerBg = gloss.Color("#ebfc2b")
+		headerBg = CFG.Colors.CursorHeader
 	}
 
 	// Render the file header
 	view[0] = gloss.NewStyle().
 		Width(m.w).
 		Background(headerBg).
-		Foreground(gloss.Color("#000")).
+		Foreground(CFG.Colors.HeaderText).
 		Render(fmt.Sprintf(" %s %s%s", ecSymbol, f.newPath, modeString))
 
-	// Start from 1 to ignore space for header
-	for i := 1; i < numLines; i++ {
-		objIdx, objType := DivMod(f.lineMap[startLine+i], NUM_FR_TYPES)
-		isCursor := i+startLine == cursor
-
-		if objType == FRLine {
-			line := f.ff.lines[objIdx]
-			view[i] = f.renderLine(line, isCursor, m)
-		} else if objType == FRAbr {
-			var bgColor gloss.Color
-			if isCursor {
-				bgColor = gloss.Color(bgColorMap[4])
-			} else {
-				bgColor = gloss.Color(bgColorMap[0])
-			}
+	// Skip the rows covered by the header and, once scrolled, the scope line
+	sticky := Max(f.StickyRows(startLine), 1)
+	if sticky > 1 && numLines > 1 {
+		scopeRow := startLine + sticky
+		if cursor >= scopeRow {
+			scopeRow = cursor
+		}
 
-			view[i] = gloss.NewStyle().
-				Width(m.w).
-				Align(gloss.Center).
-				Background(bgColor).
-				Render("...")
-		} else if objType == FRComment {
-			comment := f.comments[objIdx]
-
-			if isCursor {
-				log.Trace().Msg(fmt.Sprintf("Highlighted comment. Obj idx: %d. Comment: %#v", objIdx, comment))
-			}
+		scope := ""
+		if lineIdx := f.lineIdxAt(scopeRow); lineIdx >= 0 {
+			scope = f.scopeOf(lineIdx)
+		}
 
-			blockLines := strings.Split(comment.Render(vp, isCursor), "\n")
-			for _, line := range blockLines {
-				if i >= numLines {
-					// Don't append past the end of the view buffer
-					break
-				}
-				view[i] = line
-				i++
-			}
-			i--
-		} else if objType == FRBlank {
-			view[i] = gloss.NewStyle().
-				Width(m.w).
-				Background(gloss.Color(bgColorMap[0])).
-				Render(".")
-		} else {
-			view[i] = gloss.NewStyle().
+		view[1] = gloss.NewStyle().
+			Width(m.w).
+			MaxWidth(m.w).
+			Inline(true).
+			Background(CFG.Colors.Scope).
+			Foreground(CFG.Colors.ScopeText).
+			Render(fmt.Sprintf("%*s %s", f.gutterWidth(vp)-1, "", scope))
+	}
+
+	selLo, selHi, selecting := m.selectedRows(f)
+
+	for i := sticky; i < numLines; {
+		// The first row may be partway through a comment or wrapped line, in
+		// which case only the rest of it is shown
+		row := startLine + i
+		owner := row
+		for owner > 0 && f.lineMap[owner] == FRBlank {
+			owner--
+		}
+
+		// Selected lines are drawn as though the cursor is on them
+		selected := selecting && selLo <= owner && owner <= selHi && f.GetRowType(owner) == FRLine
+		block := f.renderRows(owner, owner == cursor || selected, vp, m)
+		if row-owner >= len(block) {
+			// The layout is out of step with what's being rendered
+			block = append(block, gloss.NewStyle().
 				Width(m.w).
-				Background(gloss.Color(bgColorMap[0])).
-				Render("Whoops!")
+				Background(CFG.Colors.LineBackgrounds[0]).
+				Render("Whoops!"))
+			owner = row - len(block) + 1
+		}
+
+		for k := row - owner; k < len(block) && i < numLines; k++ {
+			view[i] = block[k]
+			i++
 		}
 	}
 
 	return strings.Join(view, "\n")
 }
 
-func (f *FileRegion) renderLine(line *FormattedLine, cursor bool, m *Model) string {
-	var lineContent string
+// Renders every row of the object at row, e.g. all of a comment.
+func (f *FileRegion) renderRows(row int, isCursor bool, vp *ViewParams, m *Model) []string {
+	objIdx, objType := DivMod(f.lineMap[row], NUM_FR_TYPES)
+
+	switch objType {
+	case FRLine:
+		return f.renderLine(objIdx, isCursor, m)
+	case FRAbr:
+		var bgColor gloss.Color
+		if isCursor {
+			bgColor = CFG.Colors.LineBackgrounds[4]
+		} else {
+			bgColor = CFG.Colors.LineBackgrounds[0]
+		}
+
+		abr := f.abrs[objIdx]
+		return []string{gloss.NewStyle().
+			Align(gloss.Center).
+			Background(bgColor).
+			Render(fmt.Sprintf("... %d hidden lines ...", abr.end-abr.start+1))}
+	case FRComment:
+		comment := f.comments[objIdx]
+
+		if isCursor {
+			log.Trace().Msg(fmt.Sprintf("Highlighted comment. Obj idx: %d. Comment: %#v", objIdx, comment))
+		}
+
+		return strings.Split(comment.Render(vp, isCursor), "\n")
+	}
+
+	return nil
+}
+
+// Columns taken up by line numbers and the +/- marker.
+func (f *FileRegion) gutterWidth(vp *ViewParams) int {
+	if f.showsBlame(vp) {
+		return f.lineNoColWidth*2 + 4 + blameWidth
+	}
+	return f.lineNoColWidth*2 + 4
+}
+
+func (f *FileRegion) codeWidth(vp *ViewParams) int {
+	return Max(vp.width-f.gutterWidth(vp), 1)
+}
+
+// How many rows line takes up, which is only ever more than one when
+// wrapping.
+func (f *FileRegion) lineRows(line *FormattedLine, vp *ViewParams) int {
+	if !vp.settings.wrap {
+		return 1
+	}
+
+	codeWidth := f.codeWidth(vp)
+	return Max((line.Width(f.tabWidth)+codeWidth-1)/codeWidth, 1)
+}
+
+// How far lines can be scrolled horizontally before the end of the longest
+// one goes out of view.
+func (f *FileRegion) maxScrollX(vp *ViewParams) int {
+	longest := 0
+	for _, line := range f.ff.lines {
+		longest = Max(longest, line.Width(f.tabWidth))
+	}
+
+	return Max(longest-f.codeWidth(vp), 0)
+}
+
+// Renders a line, scrolled horizontally by m.x or, when wrapping, split over
+// as many rows as it needs.
+func (f *FileRegion) renderLine(lineIdx int, cursor bool, m *Model) []string {
+	var gutter string
+	vp := m.viewParams(f.lineNoColWidth)
+	line := f.ff.lines[lineIdx]
 	bgIdx := line.mode
 	if cursor {
 		bgIdx = bgIdx | 4
 	}
-	background := gloss.Color(bgColorMap[bgIdx])
+	background := CFG.Colors.LineBackgrounds[bgIdx]
+	if line.moved != nil {
+		background = CFG.Colors.MovedBackgrounds[bgIdx]
+	}
 
 	if line.mode == UNCHANGED {
-		lineContent = fmt.Sprintf(
-			"%*d %*d   %s",
+		gutter = fmt.Sprintf(
+			"%*d %*d   ",
 			f.lineNoColWidth, line.aNum,
 			f.lineNoColWidth, line.bNum,
-			line.Render(background),
 		)
 	} else if line.mode == ADDED {
-		lineContent = fmt.Sprintf(
-			"%*s %*d + %s",
+		gutter = fmt.Sprintf(
+			"%*s %*d + ",
 			f.lineNoColWidth, "",
 			f.lineNoColWidth, line.bNum,
-			line.Render(background),
 		)
 	} else {
-		lineContent = fmt.Sprintf(
-			"%*d %*s - %s",
+		gutter = fmt.Sprintf(
+			"%*d %*s - ",
 			f.lineNoColWidth, line.aNum,
 			f.lineNoColWidth, "",
-			line.Render(background),
 		)
 	}
 
-	return gloss.NewStyle().
+	if f.fullView != fullViewOff {
+		// Only one side is shown, so changes are marked in the gutter
+		// rather than by the whole line's colour
+		background = CFG.Colors.LineBackgrounds[bgIdx&^3]
+		marker := gloss.NewStyle().Background(background).Render(" ")
+		if line.mode != UNCHANGED {
+			marker = gloss.NewStyle().
+				Background(CFG.Colors.LineBackgrounds[line.mode|4]).
+				Render(gutter[len(gutter)-2 : len(gutter)-1]) // The + or -
+		} else if lineIdx > 0 && !f.showsLine(f.ff.lines[lineIdx-1]) {
+			// The other side has lines here which aren't shown
+			marker = gloss.NewStyle().Background(background).Render("^")
+		}
+
+		gutter = gloss.NewStyle().Background(background).Render(gutter[:len(gutter)-2]) +
+			marker +
+			gloss.NewStyle().Background(background).Render(" ")
+	}
+
+	if f.showsBlame(vp) {
+		blame := gloss.NewStyle().
+			Background(background).
+			Foreground(CFG.Colors.Blame).
+			Render(f.blameGutter(line))
+		// The line's own style doesn't survive the blame's ending
+		if f.fullView == fullViewOff {
+			gutter = gloss.NewStyle().Background(background).Render(gutter)
+		}
+		gutter = blame + gutter
+	}
+
+	style := gloss.NewStyle().
 		Width(m.w).
 		Background(background).
 		Inline(true).
-		MaxWidth(m.w).
-		Render(lineContent)
+		MaxWidth(m.w)
+	codeWidth := f.codeWidth(vp)
+
+	if !vp.settings.wrap {
+		return []string{style.Render(gutter + line.RenderSlice(background, m.x, codeWidth, f.tabWidth, vp.settings.showWhitespace))}
+	}
+
+	rows := make([]string, f.lineRows(line, vp))
+	for k := range rows {
+		if k > 0 {
+			gutter = fmt.Sprintf("%*s", f.gutterWidth(vp), "")
+		}
+		rows[k] = style.Render(gutter + line.RenderSlice(background, k*codeWidth, codeWidth, f.tabWidth, vp.settings.showWhitespace))
+	}
+
+	return rows
+}
+
+// Once the top of the file has been scrolled past, its header stays on the
+// first row and the scope the code on screen is in goes on the second.
+func (f *FileRegion) StickyRows(startLine int) int {
+	if f.collapsed || startLine == 0 {
+		return 0
+	}
+
+	return Min(2, f.Height()-startLine)
+}
+
+// The index of the line at row, or the closest one above it if row is a
+// comment or hidden lines. -1 if there are none.
+func (f *FileRegion) lineIdxAt(row int) int {
+	for row = Min(row, len(f.lineMap)-1); row > 0; row-- {
+		objIdx, objType := DivMod(f.lineMap[row], NUM_FR_TYPES)
+		if f.lineMap[row] == FRBlank {
+			continue
+		}
+
+		switch objType {
+		case FRLine:
+			return objIdx
+		case FRAbr:
+			return f.abrs[objIdx].end
+		}
+	}
+
+	return -1
+}
+
+// The line opening the innermost scope around ff.lines[lineIdx], going by
+// indentation. Where that doesn't turn anything up, the section heading from
+// the hunk header is used instead.
+func (f *FileRegion) scopeOf(lineIdx int) string {
+	lines := f.ff.lines
+	mode := lines[lineIdx].mode
+
+	// Lines from the other side of the diff aren't part of this line's code
+	inSide := func(line *FormattedLine) bool {
+		return line.mode == UNCHANGED || mode == UNCHANGED || line.mode == mode
+	}
+
+	ref := lineIdx
+	for ref > 0 && (!inSide(lines[ref]) || strings.TrimSpace(lines[ref].Text()) == "") {
+		ref--
+	}
+
+	refIndent := indentation(lines[ref].Text())
+	for i := ref - 1; i >= 0 && refIndent > 0; i-- {
+		text := lines[i].Text()
+		if !inSide(lines[i]) || strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		if indentation(text) < refIndent {
+			return strings.TrimSpace(text)
+		}
+	}
+
+	return lines[lineIdx].section
+}
+
+func (f *FileRegion) GetRowType(cursor int) int {
+	if f.collapsed || cursor <= 0 || cursor >= len(f.lineMap) {
+		return FRHeader
+	}
+
+	// Blank rows belong to whatever object precedes them
+	for cursor > 0 && f.lineMap[cursor] == FRBlank {
+		cursor--
+	}
+
+	_, objType := DivMod(f.lineMap[cursor], NUM_FR_TYPES)
+	return objType
 }
 
 func (f *FileRegion) GetNextCursorTarget(lineNo int, direction int) int {
@@ -337,12 +574,7 @@ func (f *FileRegion) Height() int {
 }
 
 func (f *FileRegion) Resize(m *Model) {
-	vp := &ViewParams{
-		x:              0,
-		width:          m.w,
-		lineNoColWidth: f.lineNoColWidth,
-	}
-	f.updateLineMap(vp)
+	f.updateLineMap(m.viewParams(f.lineNoColWidth))
 }
 
 func (f *FileRegion) GetPendingComments() []Comment {
@@ -357,19 +589,200 @@ func (f *FileRegion) GetPendingComments() []Comment {
 	return pendingNotes
 }
 
+func (f *FileRegion) GetAnchor(cursor int) Anchor {
+	if f.collapsed || cursor <= 0 || cursor >= len(f.lineMap) {
+		return Anchor{objType: FRHeader}
+	}
+
+	// Blank rows belong to whatever object precedes them
+	for cursor > 0 && f.lineMap[cursor] == FRBlank {
+		cursor--
+	}
+
+	anchor := Anchor{}
+	objIdx, objType := DivMod(f.lineMap[cursor], NUM_FR_TYPES)
+	anchor.objType = objType
+
+	switch objType {
+	case FRLine:
+		anchor.line = f.ff.lines[objIdx]
+	case FRAbr:
+		anchor.line = f.ff.lines[f.abrs[objIdx].start]
+	case FRComment:
+		anchor.comment = f.comments[objIdx]
+		for i := cursor - 1; i > 0; i-- {
+			lineIdx, rowType := DivMod(f.lineMap[i], NUM_FR_TYPES)
+			if rowType == FRLine {
+				anchor.line = f.ff.lines[lineIdx]
+				break
+			}
+		}
+	}
+
+	return anchor
+}
+
+func (f *FileRegion) ResolveAnchor(anchor Anchor) int {
+	if f.collapsed || anchor.objType == FRHeader {
+		return 0
+	}
+
+	if anchor.comment != nil {
+		for row, entry := range f.lineMap {
+			objIdx, objType := DivMod(entry, NUM_FR_TYPES)
+			if objType == FRComment && f.comments[objIdx] == anchor.comment {
+				return row
+			}
+		}
+	}
+
+	if anchor.line == nil {
+		return 0
+	}
+
+	lineIdx := -1
+	for idx, line := range f.ff.lines {
+		if line == anchor.line {
+			lineIdx = idx
+			break
+		}
+	}
+
+	// The diff has been rebuilt, so look for the line by number instead
+	if lineIdx < 0 {
+		for idx, line := range f.ff.lines {
+			sameNew := anchor.line.mode != REMOVED && line.mode != REMOVED && line.bNum == anchor.line.bNum
+			sameOld := anchor.line.mode == REMOVED && line.mode != ADDED && line.aNum == anchor.line.aNum
+			if sameNew || sameOld {
+				lineIdx = idx
+				break
+			}
+		}
+	}
+
+	for row, entry := range f.lineMap {
+		objIdx, objType := DivMod(entry, NUM_FR_TYPES)
+		// Lines appear in order, so if the line itself isn't shown (e.g.
+		// only one side of the diff is) the next one after it is used
+		if objType == FRLine && objIdx >= lineIdx && lineIdx >= 0 && entry != FRBlank {
+			return row
+		}
+		if objType == FRAbr && f.abrs[objIdx].start <= lineIdx && lineIdx <= f.abrs[objIdx].end {
+			return row
+		}
+	}
+
+	return 0
+}
+
+// Reconciles the region's comments with a freshly fetched set. Notes are
+// matched by id and updated in place, so anchors to them stay valid. Pending
+// drafts are never touched.
+func (f *FileRegion) MergeComments(fetched []Comment, vp *ViewParams) (added int, changed int, removed int) {
+	fetchedById := make(map[int]*GLNote)
+	for _, comment := range fetched {
+		note := comment.(*GLNote)
+		fetchedById[note.Id] = note
+	}
+
+	var merged []Comment
+	seen := make(map[int]bool)
+
+	for _, comment := range f.comments {
+		note := comment.(*GLNote)
+		if note.IsPending() {
+			merged = append(merged, comment)
+			continue
+		}
+
+		update, ok := fetchedById[note.Id]
+		if !ok {
+			removed++
+			continue
+		}
+
+		seen[note.Id] = true
+		if update.Body != note.Body || update.UpdatedAt != note.UpdatedAt {
+			*note = *update
+			changed++
+		}
+		merged = append(merged, comment)
+	}
+
+	for _, comment := range fetched {
+		note := comment.(*GLNote)
+		if !seen[note.Id] {
+			merged = append(merged, comment)
+			added++
+		}
+	}
+
+	f.comments = merged
+	f.revealCommentedLines()
+	f.updateLineMap(vp)
+
+	return added, changed, removed
+}
+
+func (f *FileRegion) Highlight() tea.Cmd {
+	if f.collapsed {
+		return nil
+	}
+
+	return f.ff.HighlightCmd()
+}
+
+func (f *FileRegion) containsLine(line *FormattedLine) bool {
+	for _, l := range f.ff.lines {
+		if l == line {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (f *FileRegion) SetECState(value bool) {
 	f.collapsed = value
 }
 
-func (f *FileRegion) updateLineMap(vp *ViewParams) {
-	f.lineMap = make([]int, 1)
-	lineIdx := 0
-	abrIdx := 0
-	commentIndex := make(map[string]([]int))
+// Works out which line each comment hangs off of, keyed by index into
+// ff.lines. Comments are matched on both line numbers and the side of the diff
+// first. When the diff was computed locally the line may be on a different
+// side (or unchanged) than it was in GitLab's diff, so failing that they're
+// matched on the new line number or, for removed lines, the old one.
+func (f *FileRegion) commentsByLine() map[int][]int {
+	exact := make(map[string]int)
+	byNew := make(map[int]int)
+	byOld := make(map[int]int)
+
+	for idx, line := range f.ff.lines {
+		if line.mode == ADDED {
+			exact[fmt.Sprintf("+%d", line.bNum)] = idx
+		} else if line.mode == REMOVED {
+			exact[fmt.Sprintf("-%d", line.aNum)] = idx
+		} else {
+			exact[fmt.Sprintf(" %d_%d", line.bNum, line.aNum)] = idx
+		}
 
+		if line.mode != REMOVED {
+			byNew[line.bNum] = idx
+		}
+		if line.mode != ADDED {
+			byOld[line.aNum] = idx
+		}
+	}
+
+	index := make(map[int][]int)
 	for cidx, comment := range f.comments {
 		var key string
 		pos := comment.GetPosition()
+		if f.inCommit != nil {
+			var shown bool
+			if pos, shown = f.inCommit.commitPosition(pos); !shown {
+				continue
+			}
+		}
 		if pos.NewLine == 0 {
 			key = fmt.Sprintf("-%d", pos.OldLine)
 		} else if pos.OldLine == 0 {
@@ -378,97 +791,346 @@ func (f *FileRegion) updateLineMap(vp *ViewParams) {
 			key = fmt.Sprintf(" %d_%d", pos.NewLine, pos.OldLine)
 		}
 
-		if _, ok := commentIndex[key]; !ok {
-			commentIndex[key] = nil
+		lineIdx, ok := exact[key]
+		if !ok && pos.NewLine > 0 {
+			lineIdx, ok = byNew[pos.NewLine]
 		}
+		if !ok && pos.OldLine > 0 {
+			lineIdx, ok = byOld[pos.OldLine]
+		}
+		if ok {
+			index[lineIdx] = append(index[lineIdx], cidx)
+		}
+	}
 
-		commentIndex[key] = append(commentIndex[key], cidx)
+	return index
+}
 
-	}
+func (f *FileRegion) updateLineMap(vp *ViewParams) {
+	f.lineMap = make([]int, 1)
+	lineIdx := 0
+	abrIdx := 0
+	commentIndex := f.commentsByLine()
+	// Comments on lines which aren't shown, waiting for the next line which is
+	var carried []int
 
 	f.lineMap[0] = FRHeader
 
+	appendComments := func(cidxs []int) {
+		for _, cidx := range cidxs {
+			note := f.comments[cidx]
+			f.lineMap = append(f.lineMap, (cidx*NUM_FR_TYPES)+FRComment)
+			commentHeight := note.Height(vp)
+			for i := 1; i < commentHeight; i++ {
+				f.lineMap = append(f.lineMap, FRBlank)
+			}
+		}
+	}
+
 	for lineIdx < len(f.ff.lines) {
-		if abrIdx < len(f.abrs) && lineIdx == f.abrs[abrIdx].start {
+		if f.fullView == fullViewOff && abrIdx < len(f.abrs) && lineIdx == f.abrs[abrIdx].start {
 			f.lineMap = append(f.lineMap, (abrIdx*NUM_FR_TYPES)+FRAbr)
 			lineIdx = f.abrs[abrIdx].end + 1
 			abrIdx++
+		} else if !f.showsLine(f.ff.lines[lineIdx]) {
+			carried = append(carried, commentIndex[lineIdx]...)
+			lineIdx++
 		} else {
 			f.lineMap = append(f.lineMap, (lineIdx*NUM_FR_TYPES)+FRLine)
-			var key string
-			formattedLine := f.ff.lines[lineIdx]
-
-			if formattedLine.mode == ADDED {
-				key = fmt.Sprintf("+%d", formattedLine.bNum)
-			} else if formattedLine.mode == REMOVED {
-				key = fmt.Sprintf("-%d", formattedLine.aNum)
-			} else {
-				key = fmt.Sprintf(" %d_%d", formattedLine.bNum, formattedLine.aNum)
+			for i := 1; i < f.lineRows(f.ff.lines[lineIdx], vp); i++ {
+				f.lineMap = append(f.lineMap, FRBlank)
 			}
 
-			if commentIndicies, ok := commentIndex[key]; ok {
-				for _, cidx := range commentIndicies {
-					note := f.comments[cidx]
-					f.lineMap = append(f.lineMap, (cidx*NUM_FR_TYPES)+FRComment)
-					commentHeight := note.Height(vp)
-					for i := 1; i < commentHeight; i++ {
-						f.lineMap = append(f.lineMap, FRBlank)
-					}
-				}
-			}
+			appendComments(carried)
+			appendComments(commentIndex[lineIdx])
+			carried = nil
 
 			lineIdx++
 		}
 	}
+
+	appendComments(carried)
 }
 
-func newFileRegion(ff *FormattedFile, change GLChangeData, comments []Comment, width int) *FileRegion {
-	region := FileRegion{
-		ff:        ff,
-		oldPath:   change.OldPath,
-		newPath:   change.NewPath,
-		added:     change.NewFile,
-		removed:   change.DeletedFile,
-		collapsed: change.DeletedFile,
-		comments:  comments,
+// Whether line is on the side of the diff being shown. Both are, unless the
+// whole of one version of the file is being shown.
+func (f *FileRegion) showsLine(line *FormattedLine) bool {
+	switch f.fullView {
+	case fullViewHead:
+		return line.mode != REMOVED
+	case fullViewBase:
+		return line.mode != ADDED
+	}
+
+	return true
+}
+
+// Moves on to showing the next of: just the changes, the whole of head and
+// the whole of base. Returns a description of what's now shown.
+func (f *FileRegion) CycleFullView(vp *ViewParams) string {
+	f.fullView = (f.fullView + 1) % 3
+	// New and deleted files only have the one side
+	if f.fullView == fullViewHead && f.removed {
+		f.fullView = fullViewBase
+	}
+	if f.fullView == fullViewBase && f.added {
+		f.fullView = fullViewOff
 	}
 
-	inNonAbr := ff.lines[0].mode != UNCHANGED
-	lastNonAbrEnd := 0
-	linesWithoutChange := 0
+	f.collapsed = false
+	f.updateLineMap(vp)
 
-	for idx, line := range ff.lines {
-		if line.mode == UNCHANGED {
-			linesWithoutChange++
+	switch f.fullView {
+	case fullViewHead:
+		return fmt.Sprintf("all of %s as of head", f.newPath)
+	case fullViewBase:
+		return fmt.Sprintf("all of %s as of base", f.oldPath)
+	}
+
+	return fmt.Sprintf("the changes to %s", f.newPath)
+}
+
+// Hides runs of at least threshold unchanged lines, leaving contextLines
+// either side of each change visible.
+func (f *FileRegion) buildAbridgements(contextLines int, threshold int) {
+	// Lines with comments on are kept in view as though they were changes
+	commented := f.commentsByLine()
+	isChange := func(idx int) bool {
+		_, hasComments := commented[idx]
+		return hasComments || f.ff.opts.IsChange(f.ff.lines[idx])
+	}
+
+	f.abrs = nil
+	// First line of the current run of unchanged lines
+	runStart := 0
+
+	for idx := 0; idx <= len(f.ff.lines); idx++ {
+		if idx < len(f.ff.lines) && !isChange(idx) {
+			continue
+		}
 
-			if inNonAbr && linesWithoutChange >= 10 {
-				inNonAbr = false
-				lastNonAbrEnd = idx - 5
+		// The start and end of the file only need context on one side
+		hideStart, hideEnd := runStart, idx-1
+		if runStart > 0 {
+			hideStart += contextLines
+		}
+		if idx < len(f.ff.lines) {
+			hideEnd -= contextLines
+		}
+
+		if idx-runStart >= threshold && hideStart <= hideEnd {
+			f.abrs = append(f.abrs, abridgement{start: hideStart, end: hideEnd})
+		}
+		runStart = idx + 1
+	}
+}
+
+// Splits abridgements around lines with comments on, so comments which arrive
+// on lines hidden since the abridgements were built can be seen.
+func (f *FileRegion) revealCommentedLines() {
+	commented := f.commentsByLine()
+
+	var abrs []abridgement
+	for _, abr := range f.abrs {
+		start := abr.start
+		for idx := abr.start; idx <= abr.end; idx++ {
+			if _, ok := commented[idx]; !ok {
+				continue
 			}
-		} else {
-			linesWithoutChange = 0
-
-			if !inNonAbr {
-				inNonAbr = true
-				region.abrs = append(region.abrs, abridgement{
-					start: lastNonAbrEnd,
-					end:   Max(0, Max(lastNonAbrEnd, idx-5)),
-				})
+
+			if idx > start {
+				abrs = append(abrs, abridgement{start: start, end: idx - 1})
+			}
+			start = idx + 1
+		}
+
+		if start <= abr.end {
+			abrs = append(abrs, abridgement{start: start, end: abr.end})
+		}
+	}
+
+	f.abrs = abrs
+}
+
+// Rebuilds the abridgements with a different amount of context, undoing any
+// expansion done so far.
+func (f *FileRegion) SetContext(vp *ViewParams) {
+	f.buildAbridgements(vp.settings.contextLines, vp.settings.contextThreshold)
+	f.updateLineMap(vp)
+}
+
+// Swaps the diff being shown, rebuilding the layout around it. Passing nil
+// goes back to GitLab's diff.
+func (f *FileRegion) SetDiff(ff *FormattedFile, vp *ViewParams) {
+	if ff == nil {
+		if f.serverFF == nil {
+			return
+		}
+		ff, f.serverFF = f.serverFF, nil
+	} else if f.serverFF == nil {
+		f.serverFF = f.ff
+	}
+
+	f.ff = ff
+	f.buildAbridgements(vp.settings.contextLines, vp.settings.contextThreshold)
+	f.lineNoColWidth = GetLineNoColWidth(ff)
+	vp.lineNoColWidth = f.lineNoColWidth
+	f.updateLineMap(vp)
+}
+
+// The old and new line numbers to give a comment on line. GitLab only accepts
+// positions which make sense in its own diff, so when a local diff is shown
+// the line is looked up in GitLab's to see which side it's really on.
+func (f *FileRegion) commentLines(line *FormattedLine) (oldLine int, newLine int) {
+	if line.mode != ADDED {
+		oldLine = line.aNum
+	}
+	if line.mode != REMOVED {
+		newLine = line.bNum
+	}
+
+	if f.serverFF == nil {
+		return oldLine, newLine
+	}
+
+	for _, serverLine := range f.serverFF.lines {
+		if newLine > 0 && serverLine.mode != REMOVED && serverLine.bNum == newLine {
+			if serverLine.mode == ADDED {
+				return 0, newLine
+			}
+			return serverLine.aNum, newLine
+		}
+		if newLine == 0 && serverLine.mode != ADDED && serverLine.aNum == oldLine {
+			if serverLine.mode == REMOVED {
+				return oldLine, 0
+			}
+			return oldLine, serverLine.bNum
+		}
+	}
+
+	return oldLine, newLine
+}
+
+// Reveals the first top and last bottom lines hidden by abridgement idx,
+// removing it once nothing is left hidden. Returns the number of rows
+// inserted above the abridgement's row.
+func (f *FileRegion) revealLines(idx int, top int, bottom int, vp *ViewParams) int {
+	abrRow := func() int {
+		for row, entry := range f.lineMap {
+			if entry == idx*NUM_FR_TYPES+FRAbr {
+				return row
 			}
 		}
+		return 0
 	}
 
-	if !inNonAbr {
-		region.abrs = append(region.abrs, abridgement{
-			start: lastNonAbrEnd,
-			end:   len(ff.lines) - 1,
-		})
+	abr := &f.abrs[idx]
+	if abr.end-abr.start+1 <= top+bottom {
+		f.abrs = append(f.abrs[:idx], f.abrs[idx+1:]...)
+		f.updateLineMap(vp)
+		return 0
 	}
 
+	// Revealed lines may wrap or carry comments, so count the rows rather
+	// than the lines
+	before := abrRow()
+	abr.start += top
+	abr.end -= bottom
+	f.updateLineMap(vp)
+	return abrRow() - before
+}
+
+// The column text's code starts at. Tabs go to the next multiple of 8, which
+// is as good as any width for comparing lines from the same file.
+func indentation(text string) int {
+	col := 0
+	for _, r := range text {
+		switch r {
+		case ' ':
+			col++
+		case '\t':
+			col += 8 - col%8
+		default:
+			return col
+		}
+	}
+
+	return col
+}
+
+// Works out how much of abridgement idx to reveal so that the scope the
+// neighbouring change sits in is fully visible, going by indentation. The
+// scope's opening line is looked for above the change or, at the end of a
+// file, its closing line below the preceding code. ok is false if the change
+// is at the top level.
+func (f *FileRegion) enclosingScope(idx int) (top int, bottom int, ok bool) {
+	abr := f.abrs[idx]
+	lines := f.ff.lines
+
+	// The first non-blank line after the block, or failing that before it
+	ref := -1
+	direction := -1
+	for i := abr.end + 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i].Text()) != "" {
+			ref = i
+			break
+		}
+	}
+	if ref < 0 {
+		direction = 1
+		for i := abr.start - 1; i >= 0; i-- {
+			if strings.TrimSpace(lines[i].Text()) != "" {
+				ref = i
+				break
+			}
+		}
+	}
+	if ref < 0 {
+		return 0, 0, false
+	}
+
+	refIndent := indentation(lines[ref].Text())
+	if refIndent == 0 {
+		return 0, 0, false
+	}
+
+	size := abr.end - abr.start + 1
+	if direction < 0 {
+		for i := abr.end; i >= abr.start; i-- {
+			text := lines[i].Text()
+			if strings.TrimSpace(text) != "" && indentation(text) < refIndent {
+				return 0, abr.end - i + 1, true
+			}
+		}
+	} else {
+		for i := abr.start; i <= abr.end; i++ {
+			text := lines[i].Text()
+			if strings.TrimSpace(text) != "" && indentation(text) < refIndent {
+				return i - abr.start + 1, 0, true
+			}
+		}
+	}
+
+	// The scope starts (or ends) outside the block, so all of it is in scope
+	return size, 0, true
+}
+
+func newFileRegion(ff *FormattedFile, change GLChangeData, comments []Comment, vp ViewParams) *FileRegion {
+	region := FileRegion{
+		ff:        ff,
+		oldPath:   change.OldPath,
+		newPath:   change.NewPath,
+		added:     change.NewFile,
+		removed:   change.DeletedFile,
+		collapsed: change.DeletedFile,
+		comments:  comments,
+		tabWidth:  tabWidthFor(change.NewPath, ff.lexer),
+	}
+
+	region.buildAbridgements(vp.settings.contextLines, vp.settings.contextThreshold)
+
 	region.lineNoColWidth = GetLineNoColWidth(ff)
-	region.updateLineMap(&ViewParams{
-		lineNoColWidth: region.lineNoColWidth,
-		width:          width,
-	})
+	vp.lineNoColWidth = region.lineNoColWidth
+	region.updateLineMap(&vp)
 	return &region
 }
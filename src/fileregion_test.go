@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Builds a region from a layout where '+' is a changed line and '.' an
+// unchanged one.
+func regionOf(layout string) *FileRegion {
+	ff := &FormattedFile{}
+	for _, c := range layout {
+		mode := UNCHANGED
+		if c == '+' {
+			mode = ADDED
+		}
+		ff.lines = append(ff.lines, &FormattedLine{mode: mode})
+	}
+
+	return &FileRegion{ff: ff}
+}
+
+func TestBuildAbridgements(t *testing.T) {
+	tests := []struct {
+		name      string
+		layout    string
+		lines     int
+		threshold int
+		want      []abridgement
+	}{
+		{"no gaps", "+++", 2, 3, nil},
+		{"gap under threshold", "+..+", 1, 3, nil},
+		{"context both sides", "+......+", 2, 3, []abridgement{{3, 4}}},
+		{"gap all context", "+....+", 2, 3, nil},
+		{"start of file", "......+", 2, 3, []abridgement{{0, 3}}},
+		{"end of file", "+......", 2, 3, []abridgement{{3, 6}}},
+		{"short start of file", "..+", 1, 3, nil},
+		{"no context", "+...+", 0, 1, []abridgement{{1, 3}}},
+		{"unchanged file", "....", 1, 3, []abridgement{{0, 3}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := regionOf(tt.layout)
+			f.buildAbridgements(tt.lines, tt.threshold)
+			if !reflect.DeepEqual(f.abrs, tt.want) {
+				t.Errorf("buildAbridgements(%d, %d) on %q = %v, want %v", tt.lines, tt.threshold, tt.layout, f.abrs, tt.want)
+			}
+		})
+	}
+}
@@ -1,24 +1,166 @@
 package main
 
 import (
+	"container/list"
+	"crypto/sha1"
 	"fmt"
 	"github.com/alecthomas/chroma"
 	"github.com/alecthomas/chroma/lexers"
 	"github.com/alecthomas/chroma/styles"
+	tea "github.com/charmbracelet/bubbletea"
 	gloss "github.com/charmbracelet/lipgloss"
+	"github.com/rivo/uniseg"
+	"github.com/rs/zerolog/log"
 	"strings"
+	"sync"
 )
 
+const (
+	hlPlain   int = 0
+	hlPending     = 1
+	hlDone        = 2
+)
+
+// Which whitespace gets markers drawn on it.
+const (
+	WhitespaceNone     = "none"
+	WhitespaceTrailing = "trailing"
+	WhitespaceAll      = "all"
+)
+
+var whitespaceModes = []string{WhitespaceNone, WhitespaceTrailing, WhitespaceAll}
+
 type UnRenderedToken struct {
 	text  string
 	style gloss.Style
 }
 
 type FormattedLine struct {
-	tokens []UnRenderedToken
-	mode   Mode
-	aNum   int
-	bNum   int
+	tokens  []UnRenderedToken
+	mode    Mode
+	aNum    int
+	bNum    int
+	section string
+	// The other end of a move this line is part of, see detectMoves
+	moved *FormattedLine
+}
+
+func (l *FormattedLine) Text() string {
+	var b strings.Builder
+
+	for _, token := range l.tokens {
+		b.WriteString(token.text)
+	}
+
+	return b.String()
+}
+
+// A piece of a line as it's drawn, with tabs expanded.
+type displayToken struct {
+	text  string
+	style gloss.Style
+	// Trailing whitespace, which is drawn over its own background
+	trailing bool
+}
+
+// Lays the line's tokens out for display. Tabs are expanded to the next
+// multiple of tabWidth and whitespace gets markers according to show, one of
+// whitespaceModes.
+func (l *FormattedLine) display(tabWidth int, show string) []displayToken {
+	var out []displayToken
+	trailingFrom := len(strings.TrimRight(l.Text(), " \t"))
+	col, offset := 0, 0
+
+	for _, token := range l.tokens {
+		start := 0
+		for i, r := range token.text {
+			// Spaces can stay as they are unless they need a marker
+			if r != '\t' && (r != ' ' || show == WhitespaceNone) {
+				continue
+			}
+
+			if i > start {
+				out = append(out, displayToken{text: token.text[start:i], style: token.style})
+				col += cellWidth(token.text[start:i])
+			}
+			start = i + 1
+
+			width := 1
+			if r == '\t' {
+				width = tabWidth - col%tabWidth
+			}
+			col += width
+
+			ws := displayToken{text: strings.Repeat(" ", width), style: token.style}
+			ws.trailing = offset+i >= trailingFrom && show != WhitespaceNone
+			if ws.trailing || show == WhitespaceAll {
+				marker := "·"
+				if r == '\t' {
+					marker = "→"
+				}
+				ws.text = marker + ws.text[1:]
+				// Setting a property changes the style in place
+				ws.style = token.style.Copy().Foreground(CFG.Colors.Whitespace)
+			}
+			out = append(out, ws)
+		}
+
+		if start < len(token.text) {
+			out = append(out, displayToken{text: token.text[start:], style: token.style})
+			col += cellWidth(token.text[start:])
+		}
+		offset += len(token.text)
+	}
+
+	return out
+}
+
+// The line's width in terminal cells. Whitespace markers take the place of a
+// space, so whether they're shown doesn't matter.
+func (l *FormattedLine) Width(tabWidth int) int {
+	width := 0
+	for _, token := range l.display(tabWidth, WhitespaceNone) {
+		width += cellWidth(token.text)
+	}
+
+	return width
+}
+
+// Renders only the cells from start up to start+width. Characters are never
+// split, so a wide one straddling either edge is replaced by spaces.
+func (l *FormattedLine) RenderSlice(background gloss.Color, start int, width int, tabWidth int, show string) string {
+	var b strings.Builder
+	end := start + width
+	col := 0
+
+	for _, token := range l.display(tabWidth, show) {
+		var visible strings.Builder
+		g := uniseg.NewGraphemes(token.text)
+		for g.Next() && col < end {
+			cluster := g.Str()
+			clusterWidth := cellWidth(cluster)
+			from, to := col, col+clusterWidth
+			col = to
+
+			if from >= start && to <= end {
+				visible.WriteString(cluster)
+			} else if to > start && from < end {
+				visible.WriteString(strings.Repeat(" ", Min(to, end)-Max(from, start)))
+			}
+		}
+
+		if visible.Len() == 0 {
+			continue
+		}
+
+		bg := background
+		if token.trailing {
+			bg = CFG.Colors.TrailingWhitespace
+		}
+		b.WriteString(token.style.Background(bg).Render(visible.String()))
+	}
+
+	return b.String()
 }
 
 func (l *FormattedLine) Render(background gloss.Color) string {
@@ -33,6 +175,124 @@ func (l *FormattedLine) Render(background gloss.Color) string {
 
 type FormattedFile struct {
 	lines []*FormattedLine
+
+	// Highlighting is deferred until the file is actually looked at, so the
+	// reconstituted sources are retained until then.
+	hlState int
+	baseSrc string
+	targSrc string
+	lexer   chroma.Lexer
+
+	// How the diff was computed, if it was done locally
+	opts DiffOptions
+}
+
+type FileHighlightedMsg struct {
+	ff   *FormattedFile
+	base [][]UnRenderedToken
+	targ [][]UnRenderedToken
+	err  error
+}
+
+// Returns a command which highlights the file in the background, or nil if
+// highlighting is already underway or complete.
+func (ff *FormattedFile) HighlightCmd() tea.Cmd {
+	if ff.hlState != hlPlain {
+		return nil
+	}
+
+	ff.hlState = hlPending
+	baseSrc, targSrc, lexer := ff.baseSrc, ff.targSrc, ff.lexer
+
+	return func() tea.Msg {
+		msg := FileHighlightedMsg{ff: ff}
+
+		msg.base, msg.err = cachedHighlight(baseSrc, lexer)
+		if msg.err != nil {
+			return msg
+		}
+		msg.targ, msg.err = cachedHighlight(targSrc, lexer)
+
+		return msg
+	}
+}
+
+// Swaps the plain tokens of each line for highlighted ones. Must be called
+// from the update loop since views read the tokens concurrently otherwise.
+func (ff *FormattedFile) ApplyHighlight(msg FileHighlightedMsg) {
+	ff.hlState = hlDone
+	ff.baseSrc = ""
+	ff.targSrc = ""
+
+	if msg.err != nil {
+		log.Error().Err(msg.err).Msg("Unable to highlight file, leaving it plain.")
+		return
+	}
+
+	for _, line := range ff.lines {
+		if line.mode == ADDED {
+			line.tokens = msg.targ[line.bNum-1]
+		} else {
+			line.tokens = msg.base[line.aNum-1]
+		}
+	}
+}
+
+// Most lines of highlighted text kept in highlightCache, so long sessions
+// over big MRs don't hold every version of every file ever tokenised.
+const highlightCacheMaxLines = 200000
+
+type highlightCacheEntry struct {
+	key    string
+	tokens [][]UnRenderedToken
+}
+
+var highlightCache = struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	// Most recently used at the front
+	order *list.List
+	lines int
+}{entries: make(map[string]*list.Element), order: list.New()}
+
+// Highlight, but remembers results by lexer and content so files which are
+// rebuilt (or appear on both sides of a diff unchanged) are only tokenised once.
+// The least recently used results are dropped once the cache grows too big.
+func cachedHighlight(s string, lexer chroma.Lexer) ([][]UnRenderedToken, error) {
+	key := fmt.Sprintf("%s:%s:%x", CFG.SyntaxStyle, lexer.Config().Name, sha1.Sum([]byte(s)))
+
+	highlightCache.Lock()
+	if elem, ok := highlightCache.entries[key]; ok {
+		highlightCache.order.MoveToFront(elem)
+		highlightCache.Unlock()
+		return elem.Value.(*highlightCacheEntry).tokens, nil
+	}
+	highlightCache.Unlock()
+
+	highlighted, err := Highlight(s, lexer)
+	if err != nil {
+		return nil, err
+	}
+
+	highlightCache.Lock()
+	defer highlightCache.Unlock()
+
+	if _, ok := highlightCache.entries[key]; ok {
+		// Another worker highlighted the same content meanwhile
+		return highlighted, nil
+	}
+
+	highlightCache.entries[key] = highlightCache.order.PushFront(&highlightCacheEntry{key: key, tokens: highlighted})
+	highlightCache.lines += len(highlighted)
+
+	for highlightCache.lines > highlightCacheMaxLines && highlightCache.order.Len() > 1 {
+		oldest := highlightCache.order.Back()
+		entry := highlightCache.order.Remove(oldest).(*highlightCacheEntry)
+		delete(highlightCache.entries, entry.key)
+		highlightCache.lines -= len(entry.tokens)
+	}
+
+	return highlighted, nil
 }
 
 func ReconstituteDiff(df *DiffFile) (string, string) {
@@ -61,9 +321,8 @@ func Highlight(s string, baseLexer chroma.Lexer) ([][]UnRenderedToken, error) {
 	var ret [][]UnRenderedToken
 
 	lexer := chroma.Coalesce(baseLexer)
-	style := styles.Get("vim")
-	detabbed := strings.ReplaceAll(s, "\t", "  ")
-	ti, err := lexer.Tokenise(nil, detabbed)
+	style := styles.Get(CFG.SyntaxStyle)
+	ti, err := lexer.Tokenise(nil, s)
 	if err != nil {
 		return nil, err
 	}
@@ -88,49 +347,48 @@ func Highlight(s string, baseLexer chroma.Lexer) ([][]UnRenderedToken, error) {
 	return ret, nil
 }
 
+// Builds a FormattedFile with unstyled tokens. Syntax highlighting is applied
+// later, see HighlightCmd.
 func FormatFile(base string, change GLChangeData) (*FormattedFile, error) {
-	var formattedFile FormattedFile
-	var lexer chroma.Lexer
-
 	df, err := AnnotateWithDiff(base, change.Diff, change.DeletedFile)
 	if err != nil {
 		return nil, err
 	}
 
-	baseStr, targStr := ReconstituteDiff(df)
+	return formatDiffFile(df, change), nil
+}
 
-	lexer = lexers.Match(change.NewPath)
-	if lexer == nil {
-		lexer = lexers.Fallback
-	}
+// Like FormatFile, but diffs base and head locally instead of using the diff
+// from GitLab.
+func FormatDiff(base string, head string, change GLChangeData, opts DiffOptions) *FormattedFile {
+	ff := formatDiffFile(DiffContents(base, head, opts), change)
+	ff.opts = opts
 
-	baseFormatted, err := Highlight(baseStr, lexer)
-	if err != nil {
-		return nil, err
-	}
-	targFormatted, err := Highlight(targStr, lexer)
-	if err != nil {
-		return nil, err
-	}
+	return ff
+}
 
-	for _, line := range df.lines {
-		var tokens []UnRenderedToken
+func formatDiffFile(df *DiffFile, change GLChangeData) *FormattedFile {
+	var formattedFile FormattedFile
 
-		if line.mode == UNCHANGED {
-			tokens = baseFormatted[line.aNum-1]
-		} else if line.mode == REMOVED {
-			tokens = baseFormatted[line.aNum-1]
-		} else {
-			tokens = targFormatted[line.bNum-1]
-		}
+	formattedFile.baseSrc, formattedFile.targSrc = ReconstituteDiff(df)
 
+	formattedFile.lexer = lexers.Match(change.NewPath)
+	if formattedFile.lexer == nil {
+		formattedFile.lexer = lexers.Fallback
+	}
+
+	for _, line := range df.lines {
 		formattedFile.lines = append(formattedFile.lines, &FormattedLine{
-			tokens: tokens,
-			mode:   line.mode,
-			aNum:   line.aNum,
-			bNum:   line.bNum,
+			tokens: []UnRenderedToken{{
+				style: gloss.NewStyle(),
+				text:  line.text,
+			}},
+			mode:    line.mode,
+			aNum:    line.aNum,
+			bNum:    line.bNum,
+			section: line.section,
 		})
 	}
 
-	return &formattedFile, nil
+	return &formattedFile
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+)
+
+func lineOf(texts ...string) *FormattedLine {
+	line := &FormattedLine{}
+	for _, text := range texts {
+		line.tokens = append(line.tokens, UnRenderedToken{text: text})
+	}
+
+	return line
+}
+
+func TestFormattedLineWidth(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     *FormattedLine
+		tabWidth int
+		want     int
+	}{
+		{"ascii", lineOf("hello"), 4, 5},
+		{"cjk", lineOf("a漢字b"), 4, 6},
+		{"combining mark", lineOf("cafe\u0301"), 4, 4},
+		{"emoji zwj", lineOf("x" + zwjFamily + "y"), 4, 4},
+		{"tab at column 0", lineOf("\tx"), 4, 5},
+		{"tab at column 1", lineOf("a\tx"), 4, 5},
+		{"tab at column 3", lineOf("abc\tx"), 4, 5},
+		{"tab at a tab stop", lineOf("abcd\tx"), 4, 9},
+		{"tab after cjk", lineOf("漢\tx"), 4, 5},
+		{"tab after combining mark", lineOf("e\u0301\tx"), 4, 5},
+		{"tab after zwj", lineOf(zwjFamily + "a\tx"), 4, 5},
+		{"tab width 8", lineOf("ab\tx"), 8, 9},
+		{"tab split across tokens", lineOf("ab", "\tx"), 4, 5},
+		{"two tabs", lineOf("a\tb\tc"), 4, 9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.line.Width(tt.tabWidth); got != tt.want {
+				t.Errorf("Width(%d) = %d, want %d", tt.tabWidth, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderSlice(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  *FormattedLine
+		start int
+		width int
+		want  string
+	}{
+		{"whole line", lineOf("hello"), 0, 10, "hello"},
+		{"middle", lineOf("hello"), 1, 3, "ell"},
+		{"past the end", lineOf("hello"), 10, 5, ""},
+		{"cjk fits", lineOf("a漢字b"), 0, 3, "a漢"},
+		{"cjk cut at the end", lineOf("a漢字b"), 0, 2, "a "},
+		{"cjk cut at the start", lineOf("a漢字b"), 2, 3, " 字"},
+		{"cjk cut at both ends", lineOf("漢字漢"), 1, 4, " 字 "},
+		{"zwj whole", lineOf("x" + zwjFamily + "y"), 1, 2, zwjFamily},
+		{"zwj cut at the start", lineOf("x" + zwjFamily + "y"), 2, 2, " y"},
+		{"zwj cut at the end", lineOf("x" + zwjFamily + "y"), 0, 2, "x "},
+		{"combining mark kept", lineOf("cafe\u0301!"), 3, 2, "e\u0301!"},
+		{"combining mark at the end", lineOf("cafe\u0301"), 0, 4, "cafe\u0301"},
+		{"tab expanded", lineOf("a\tb"), 0, 5, "a   b"},
+		{"tab cut", lineOf("a\tb"), 2, 3, "  b"},
+		{"tab after cjk", lineOf("漢\tb"), 1, 4, "   b"},
+		{"across tokens", lineOf("ab", "漢", "cd"), 1, 4, "b漢c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stripANSI(tt.line.RenderSlice("#000000", tt.start, tt.width, 4, WhitespaceNone))
+			if got != tt.want {
+				t.Errorf("RenderSlice(%d, %d) = %q, want %q", tt.start, tt.width, got, tt.want)
+			}
+			if cellWidth(got) > tt.width {
+				t.Errorf("RenderSlice(%d, %d) is %d cells wide", tt.start, tt.width, cellWidth(got))
+			}
+		})
+	}
+}
+
+func TestRenderSliceWhitespace(t *testing.T) {
+	tests := []struct {
+		show string
+		want string
+	}{
+		{WhitespaceNone, " a  b   "},
+		{WhitespaceTrailing, " a  b·→ "},
+		{WhitespaceAll, "·a→ b·→ "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.show, func(t *testing.T) {
+			line := lineOf(" a\tb \t")
+			got := stripANSI(line.RenderSlice("#000000", 0, 10, 4, tt.show))
+			if got != tt.want {
+				t.Errorf("RenderSlice() = %q, want %q", got, tt.want)
+			}
+			if cellWidth(got) != line.Width(4) {
+				t.Errorf("Rendered %d cells, but Width() = %d", cellWidth(got), line.Width(4))
+			}
+		})
+	}
+}
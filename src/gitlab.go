@@ -8,7 +8,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
+	"regexp"
 	"strings"
 )
 
@@ -52,11 +52,11 @@ type GLNote struct {
 	CreatedAt    string     `json:"created_at"`
 	UpdatedAt    string     `json:"updated_at"`
 	Position     GLPosition `json:"position"`
-	DiscussionId int
+	DiscussionId string
 }
 
 type GLDiscussion struct {
-	Id    int      `json:"id"`
+	Id    string   `json:"id"`
 	Notes []GLNote `json:"notes"`
 }
 
@@ -74,9 +74,30 @@ type GLMRData struct {
 	Discussions  []GLDiscussion
 }
 
+var shaPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+type GLCommit struct {
+	Id           string `json:"id"`
+	ShortId      string `json:"short_id"`
+	Title        string `json:"title"`
+	Message      string `json:"message"`
+	AuthorName   string `json:"author_name"`
+	AuthoredDate string `json:"authored_date"`
+	// Only filled in when fetching a single commit
+	ParentIds []string `json:"parent_ids"`
+}
+
+// A run of lines last changed by the same commit.
+type GLBlameRange struct {
+	Commit GLCommit `json:"commit"`
+	Lines  []string `json:"lines"`
+}
+
 type GLInstance struct {
-	apiUrl string
-	cache  map[string]([]byte)
+	apiUrl    string
+	cred      *Credential
+	cache     *HTTPCache
+	transport *glTransport
 }
 
 func (n *GLNote) Height(vp *ViewParams) int {
@@ -87,34 +108,49 @@ func (n *GLNote) IsPending() bool {
 	return n.Id < 0
 }
 
+// Draws the note as a block filling the width of the view. The block is laid
+// out here rather than by lipgloss, which measures text a rune at a time and
+// so gets the width of emoji sequences and the like wrong.
 func (n *GLNote) Render(vp *ViewParams, cursor bool) string {
 	margin := vp.lineNoColWidth*2 + 2
-	bg := "#444"
-	borderColor := "#FFF"
+	bg := CFG.Colors.Note
+	borderColor := CFG.Colors.NoteBorder
 	if cursor {
-		bg = "#666"
-		borderColor = "#AF0"
+		bg = CFG.Colors.CursorNote
+		borderColor = CFG.Colors.CursorNoteBorder
 	}
 
-	width := vp.width - margin - 1
-	text := fmt.Sprintf(
-		"%s\n%s\n%s\n",
-		gloss.NewStyle().Bold(true).Render(n.Author.Name),
-		gloss.NewStyle().Foreground(gloss.Color("#AAA")).Render(strings.Repeat("―", len(n.Author.Name))),
-		n.Body,
-	)
+	// Less the border and a column of padding either side
+	width := Max(vp.width-margin-3, 1)
 
-	block := gloss.NewStyle().
-		Background(gloss.Color(bg)).
-		Width(width).
-		MarginLeft(margin).
-		Padding(0, 1).
-		Border(gloss.NormalBorder(), false, false, false, true).
-		BorderForeground(gloss.Color(borderColor)).
-		BorderBackground(gloss.Color(bg)).
-		Render(text)
+	type row struct {
+		text  string
+		style gloss.Style
+	}
+	var rows []row
+	for _, line := range wrapText(n.Author.Name, width) {
+		rows = append(rows, row{line, gloss.NewStyle().Bold(true)})
+	}
+	rule := strings.Repeat("―", Min(cellWidth(n.Author.Name), width))
+	rows = append(rows, row{rule, gloss.NewStyle().Foreground(CFG.Colors.NoteRule)})
+	for _, line := range wrapText(n.Body, width) {
+		rows = append(rows, row{line, gloss.NewStyle()})
+	}
+	rows = append(rows, row{"", gloss.NewStyle()})
+
+	border := gloss.NewStyle().Foreground(borderColor).Background(bg).Render("│")
+	padding := gloss.NewStyle().Background(bg)
+
+	lines := make([]string, len(rows))
+	for idx, row := range rows {
+		lines[idx] = strings.Repeat(" ", margin) +
+			border +
+			padding.Render(" ") +
+			row.style.Background(bg).Render(row.text) +
+			padding.Render(strings.Repeat(" ", Max(width-cellWidth(row.text), 0)+1))
+	}
 
-	return block
+	return strings.Join(lines, "\n")
 }
 
 func (n *GLNote) GetPosition() CommentPosition {
@@ -131,132 +167,212 @@ func (gl *GLInstance) authdReq(method string, url string, body io.Reader) (*http
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("PRIVATE-TOKEN", os.Getenv("GLIMRR_TOKEN"))
+	if gl.cred.OAuth {
+		req.Header.Add("Authorization", "Bearer "+gl.cred.Token)
+	} else {
+		req.Header.Add("PRIVATE-TOKEN", gl.cred.Token)
+	}
 
 	return req, nil
 }
 
-func (gl *GLInstance) InvalidateCache() {
-	gl.cache = make(map[string]([]byte))
-	os.Remove("glimrrCache.json")
+// Forgets the cached discussions for an MR, to be called after we change
+// them so the next fetch doesn't have to rely on revalidation.
+func (gl *GLInstance) InvalidateDiscussions(mr GLMRData) {
+	gl.cache.InvalidatePrefix(gl.discussionsUrl(mr.ProjectId, mr.Iid))
 }
 
+// Headers kept with cached responses so they're available on a cache hit.
+var cachedHeaders = []string{"Link", "X-Next-Page"}
+
 func (gl *GLInstance) get(url string) ([]byte, error) {
-	client := &http.Client{}
+	body, _, err := gl.cachedGet(url, false)
+	return body, err
+}
 
-	log.Debug().Str("url", url).Str("method", "GET").Msg("HTTP request...")
-	if cachedVal, present := gl.cache[url]; present {
-		log.Debug().Str("url", url).Str("method", "GET").Msg("Cache hit")
-		return cachedVal, nil
-	} else {
-		log.Debug().Str("url", url).Str("method", "GET").Msg("Cache miss, requesting...")
-		req, err := gl.authdReq("GET", url, nil)
+// Like get, but for resources which can never change (e.g. anything addressed
+// by commit SHA), so cached copies are used without revalidating.
+func (gl *GLInstance) getImmutable(url string) ([]byte, error) {
+	body, _, err := gl.cachedGet(url, true)
+	return body, err
+}
+
+// Fetches every page of a list endpoint, returning the concatenation of all
+// pages as a single JSON array.
+func (gl *GLInstance) getAll(rawUrl string) ([]byte, error) {
+	var items []json.RawMessage
+	visited := make(map[string]bool)
+
+	next, err := withPerPage(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	for next != "" && !visited[next] {
+		visited[next] = true
+
+		body, headers, err := gl.cachedGet(next, false)
 		if err != nil {
-			log.Error().Str("url", url).Str("method", "GET").Msg("Error building request.")
 			return nil, err
 		}
-		resp, err := client.Do(req)
+
+		var page []json.RawMessage
+		err = json.Unmarshal(body, &page)
 		if err != nil {
-			log.Error().Str("url", url).Str("method", "GET").Msg("Error conducting request.")
-			return nil, err
+			return nil, fmt.Errorf("Expected a list from %s: %w", next, err)
 		}
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
+		items = append(items, page...)
+
+		next, err = nextPageUrl(next, headers)
 		if err != nil {
-			log.Error().Str("url", url).Str("method", "GET").Msg("Error reading response body.")
 			return nil, err
 		}
-		if resp.StatusCode != 200 {
-			log.Error().
-				Str("url", url).
-				Str("method", "GET").
-				Int("code", resp.StatusCode).
-				Msg("Non-200 status code when executing request.")
-			return nil, fmt.Errorf("Request to %s failed with status code %d", url, resp.StatusCode)
-		}
+	}
+
+	return json.Marshal(items)
+}
 
-		gl.cache[url] = body
-		serializedCache, err := json.Marshal(gl.cache)
-		os.WriteFile("glimrrCache.json", serializedCache, 0644)
+func withPerPage(rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
 
-		return body, nil
+	q := u.Query()
+	if q.Get("per_page") == "" {
+		q.Set("per_page", "100")
 	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
 }
 
-func (gl *GLInstance) del(url string) ([]byte, error) {
-	log.Debug().Str("url", url).Str("method", "DELETE").Msg("HTTP request...")
-	client := &http.Client{}
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="next"`)
 
-	req, err := gl.authdReq("DELETE", url, nil)
-	if err != nil {
-		return nil, err
+// Works out the URL of the page after current from the response headers,
+// preferring the Link header and falling back to X-Next-Page. Returns an
+// empty string on the last page.
+func nextPageUrl(current string, headers map[string]string) (string, error) {
+	if matches := nextLinkPattern.FindStringSubmatch(headers["Link"]); matches != nil {
+		return matches[1], nil
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	nextPage := headers["X-Next-Page"]
+	if nextPage == "" {
+		return "", nil
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+
+	u, err := url.Parse(current)
 	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != 200 {
-		log.Error().
-			Str("url", url).
-			Str("method", "DELETE").
-			Int("code", resp.StatusCode).
-			Msg("Non-200 status code when executing request.")
-		return nil, fmt.Errorf("Request to %s failed with status code %d", url, resp.StatusCode)
+		return "", err
 	}
 
-	return body, nil
+	q := u.Query()
+	q.Set("page", nextPage)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
 }
 
-func (gl *GLInstance) postForm(url string, form url.Values) ([]byte, error) {
-	log.Debug().Str("url", url).Str("method", "POST").Msg("HTTP request...")
-	client := &http.Client{}
+func (gl *GLInstance) cachedGet(url string, immutable bool) ([]byte, map[string]string, error) {
+	log.Debug().Str("url", url).Str("method", "GET").Msg("HTTP request...")
+	entry, cachedBody, cached := gl.cache.Lookup(url)
+	if cached && entry.Immutable {
+		log.Debug().Str("url", url).Str("method", "GET").Msg("Cache hit")
+		return cachedBody, entry.Headers, nil
+	}
 
-	req, err := gl.authdReq("POST", url, strings.NewReader(form.Encode()))
+	if cached {
+		log.Debug().Str("url", url).Str("method", "GET").Msg("Cache hit, revalidating...")
+	} else {
+		log.Debug().Str("url", url).Str("method", "GET").Msg("Cache miss, requesting...")
+	}
+
+	resp, body, err := gl.do("GET", url, nil, func(req *http.Request) {
+		if cached && entry.ETag != "" {
+			req.Header.Add("If-None-Match", entry.ETag)
+		}
+		if cached && entry.LastModified != "" {
+			req.Header.Add("If-Modified-Since", entry.LastModified)
+		}
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		if !cached {
+			return nil, nil, &GLHTTPError{Method: "GET", Url: url, StatusCode: resp.StatusCode}
+		}
+		log.Debug().Str("url", url).Str("method", "GET").Msg("Cached copy still valid")
+		return cachedBody, entry.Headers, nil
 	}
 
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req)
+	headers := make(map[string]string)
+	for _, name := range cachedHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if immutable || etag != "" || lastModified != "" {
+		gl.cache.Store(cacheEntry{
+			URL:          url,
+			ETag:         etag,
+			LastModified: lastModified,
+			Immutable:    immutable,
+			Headers:      headers,
+		}, body)
+	}
+
+	return body, headers, nil
+}
+
+func (gl *GLInstance) del(url string) ([]byte, error) {
+	log.Debug().Str("url", url).Str("method", "DELETE").Msg("HTTP request...")
+
+	_, body, err := gl.do("DELETE", url, nil, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+
+	return body, nil
+}
+
+func (gl *GLInstance) postForm(url string, form url.Values) ([]byte, error) {
+	log.Debug().Str("url", url).Str("method", "POST").Msg("HTTP request...")
+
+	_, body, err := gl.do("POST", url, []byte(form.Encode()), func(req *http.Request) {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	})
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		log.Error().
-			Str("url", url).
-			Str("method", "POST").
-			Int("code", resp.StatusCode).
-			Msg("Non-200 status code when executing request.")
-		return nil, fmt.Errorf("Request to %s failed with status code %d", url, resp.StatusCode)
-	}
 
 	return body, nil
 }
 
 func (gl *GLInstance) Init() {
-	seralizedCache, err := os.ReadFile("glimrrCache.json")
+	gl.transport = newGLTransport(CFG.Workers)
+
+	dir, err := defaultCacheDir()
+	if err == nil {
+		gl.cache, err = NewHTTPCache(dir, CFG.Behavior.CacheMaxBytes)
+	}
+
 	if err != nil {
 		log.Error().
 			Err(err).
-			Msg("Unable to restore Gitlab cache!")
-		gl.cache = make(map[string]([]byte))
-	} else {
-		log.Debug().Msg("Restoring cache from file.")
-		json.Unmarshal(seralizedCache, &gl.cache)
+			Msg("Unable to open Gitlab cache, continuing without one!")
 	}
 }
 
+func (gl *GLInstance) discussionsUrl(projectId int, mrid int) string {
+	return fmt.Sprintf("%s/v4/projects/%d/merge_requests/%d/discussions", strings.TrimSuffix(gl.apiUrl, "/"), projectId, mrid)
+}
+
 func (gl *GLInstance) FetchMR(pid string, mrid int) (*GLMRData, error) {
 	var parsedData GLMRData
 
@@ -268,26 +384,65 @@ func (gl *GLInstance) FetchMR(pid string, mrid int) (*GLMRData, error) {
 
 	json.Unmarshal(body, &parsedData)
 
-	apiUrl = fmt.Sprintf("%s/v4/projects/%s/merge_requests/%d/discussions", strings.TrimSuffix(gl.apiUrl, "/"), url.QueryEscape(pid), mrid)
-	body, err = gl.get(apiUrl)
+	parsedData.Discussions, err = gl.FetchDiscussions(parsedData.ProjectId, parsedData.Iid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsedData, nil
+}
+
+func (gl *GLInstance) FetchDiscussions(projectId int, mrid int) ([]GLDiscussion, error) {
+	var discussions []GLDiscussion
+
+	body, err := gl.getAll(gl.discussionsUrl(projectId, mrid))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(body, &discussions)
 	if err != nil {
 		return nil, err
 	}
-	json.Unmarshal(body, &(parsedData.Discussions))
 
 	// Copy discussion IDs onto individual GLNotes
-	for _, discussion := range parsedData.Discussions {
-		for _, note := range discussion.Notes {
-			note.DiscussionId = discussion.Id
+	for _, discussion := range discussions {
+		for idx := range discussion.Notes {
+			discussion.Notes[idx].DiscussionId = discussion.Id
 		}
 	}
 
-	return &parsedData, nil
+	return discussions, nil
+}
+
+// Fetches just the current diff refs of an MR, for noticing new pushes.
+func (gl *GLInstance) FetchDiffRefs(projectId int, mrid int) (*GLDiffRefs, error) {
+	var parsedData GLMRData
+
+	apiUrl := fmt.Sprintf("%s/v4/projects/%d/merge_requests/%d", strings.TrimSuffix(gl.apiUrl, "/"), projectId, mrid)
+	body, err := gl.get(apiUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(body, &parsedData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsedData.DiffRefs, nil
 }
 
 func (gl *GLInstance) FetchFileContents(pid string, path string, ref string) (*string, error) {
 	url := fmt.Sprintf("%s/v4/projects/%s/repository/files/%s/raw?ref=%s", strings.TrimSuffix(gl.apiUrl, "/"), url.QueryEscape(pid), url.QueryEscape(path), url.QueryEscape(ref))
-	body, err := gl.get(url)
+
+	var body []byte
+	var err error
+	if shaPattern.MatchString(ref) {
+		body, err = gl.getImmutable(url)
+	} else {
+		body, err = gl.get(url)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -296,6 +451,83 @@ func (gl *GLInstance) FetchFileContents(pid string, path string, ref string) (*s
 	return &bodyAsStr, nil
 }
 
+// Lists the commits in an MR, newest first.
+func (gl *GLInstance) FetchMRCommits(projectId int, mrid int) ([]GLCommit, error) {
+	var commits []GLCommit
+
+	apiUrl := fmt.Sprintf("%s/v4/projects/%d/merge_requests/%d/commits", strings.TrimSuffix(gl.apiUrl, "/"), projectId, mrid)
+	body, err := gl.getAll(apiUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(body, &commits)
+	if err != nil {
+		return nil, err
+	}
+
+	return commits, nil
+}
+
+func (gl *GLInstance) FetchCommit(pid string, sha string) (*GLCommit, error) {
+	var commit GLCommit
+
+	apiUrl := fmt.Sprintf("%s/v4/projects/%s/repository/commits/%s", strings.TrimSuffix(gl.apiUrl, "/"), url.QueryEscape(pid), url.PathEscape(sha))
+	body, err := gl.getImmutable(apiUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(body, &commit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &commit, nil
+}
+
+// Fetches the changes a commit made, relative to its first parent.
+func (gl *GLInstance) FetchCommitDiff(pid string, sha string) ([]GLChangeData, error) {
+	var changes []GLChangeData
+
+	apiUrl := fmt.Sprintf("%s/v4/projects/%s/repository/commits/%s/diff", strings.TrimSuffix(gl.apiUrl, "/"), url.QueryEscape(pid), url.PathEscape(sha))
+	body, err := gl.getAll(apiUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(body, &changes)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func (gl *GLInstance) FetchBlame(pid string, path string, ref string) ([]GLBlameRange, error) {
+	var ranges []GLBlameRange
+
+	url := fmt.Sprintf("%s/v4/projects/%s/repository/files/%s/blame?ref=%s", strings.TrimSuffix(gl.apiUrl, "/"), url.QueryEscape(pid), url.QueryEscape(path), url.QueryEscape(ref))
+
+	var body []byte
+	var err error
+	if shaPattern.MatchString(ref) {
+		body, err = gl.getImmutable(url)
+	} else {
+		body, err = gl.get(url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(body, &ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	return ranges, nil
+}
+
 func (gl *GLInstance) CreateComment(comment GLNote, mr GLMRData) (GLDiscussion, error) {
 	var discussion GLDiscussion
 
@@ -316,9 +548,7 @@ func (gl *GLInstance) CreateComment(comment GLNote, mr GLMRData) (GLDiscussion,
 		form.Add("position[old_line]", fmt.Sprintf("%d", comment.Position.OldLine))
 	}
 
-	url := fmt.Sprintf("%s/v4/projects/%d/merge_requests/%d/discussions", strings.TrimSuffix(gl.apiUrl, "/"), mr.ProjectId, mr.Iid)
-
-	body, err := gl.postForm(url, form)
+	body, err := gl.postForm(gl.discussionsUrl(mr.ProjectId, mr.Iid), form)
 	if err != nil {
 		return discussion, err
 	}
@@ -334,7 +564,7 @@ func (gl *GLInstance) CreateComment(comment GLNote, mr GLMRData) (GLDiscussion,
 func (gl *GLInstance) DeleteComment(comment Comment, mr GLMRData) error {
 	note := comment.(*GLNote)
 	url := fmt.Sprintf(
-		"%s/v4/projects/%d/merge_requests/%d/discussions/%d/notes/%d",
+		"%s/v4/projects/%d/merge_requests/%d/discussions/%s/notes/%d",
 		strings.TrimSuffix(gl.apiUrl, "/"),
 		mr.ProjectId,
 		mr.Iid,
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestGL(t *testing.T, srv *httptest.Server) *GLInstance {
+	t.Helper()
+
+	cache, err := NewHTTPCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &GLInstance{
+		apiUrl:    srv.URL + "/api",
+		cred:      &Credential{},
+		cache:     cache,
+		transport: newGLTransport(8),
+	}
+}
+
+func TestWithPerPage(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"no query", "https://gl.example/api/v4/x", "https://gl.example/api/v4/x?per_page=100"},
+		{"other params kept", "https://gl.example/api/v4/x?a=b", "https://gl.example/api/v4/x?a=b&per_page=100"},
+		{"per_page kept", "https://gl.example/api/v4/x?per_page=20", "https://gl.example/api/v4/x?per_page=20"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withPerPage(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("withPerPage(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextPageUrl(t *testing.T) {
+	const current = "https://gl.example/api/v4/x?page=2&per_page=100"
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{
+			"link",
+			map[string]string{"Link": `<https://gl.example/api/v4/x?page=3&per_page=100>; rel="next", <https://gl.example/api/v4/x?page=9&per_page=100>; rel="last"`},
+			"https://gl.example/api/v4/x?page=3&per_page=100",
+		},
+		{
+			"link after other relations",
+			map[string]string{"Link": `<https://gl.example/api/v4/x?page=1>; rel="first", <https://gl.example/api/v4/x?page=3>;rel="next"`},
+			"https://gl.example/api/v4/x?page=3",
+		},
+		{
+			"link on the last page",
+			map[string]string{"Link": `<https://gl.example/api/v4/x?page=1>; rel="first", <https://gl.example/api/v4/x?page=2>; rel="last"`},
+			"",
+		},
+		{
+			"x-next-page",
+			map[string]string{"X-Next-Page": "3"},
+			"https://gl.example/api/v4/x?page=3&per_page=100",
+		},
+		{
+			"link preferred over x-next-page",
+			map[string]string{"Link": `<https://gl.example/api/v4/y?page=5>; rel="next"`, "X-Next-Page": "3"},
+			"https://gl.example/api/v4/y?page=5",
+		},
+		{"no headers", map[string]string{}, ""},
+		{"empty x-next-page", map[string]string{"X-Next-Page": ""}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nextPageUrl(current, tt.headers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("nextPageUrl() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type pageItem struct {
+	Page int `json:"page"`
+}
+
+func decodePages(t *testing.T, body []byte) []int {
+	t.Helper()
+
+	var items []pageItem
+	if err := json.Unmarshal(body, &items); err != nil {
+		t.Fatalf("getAll returned invalid JSON %q: %s", body, err)
+	}
+
+	pages := []int{}
+	for _, item := range items {
+		pages = append(pages, item.Page)
+	}
+
+	return pages
+}
+
+func TestGetAll(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages int
+		// Sets the headers pointing from page to the one after it
+		paginate func(w http.ResponseWriter, r *http.Request, page int)
+	}{
+		{
+			"link header",
+			3,
+			func(w http.ResponseWriter, r *http.Request, page int) {
+				w.Header().Set("Link", fmt.Sprintf(
+					`<http://%s%s?page=%d&per_page=100>; rel="next", <http://%s%s?page=3&per_page=100>; rel="last"`,
+					r.Host, r.URL.Path, page+1, r.Host, r.URL.Path,
+				))
+			},
+		},
+		{
+			"x-next-page only",
+			3,
+			func(w http.ResponseWriter, r *http.Request, page int) {
+				w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+			},
+		},
+		{"single page", 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested []int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("per_page") != "100" {
+					t.Errorf("Request for %s without per_page=100", r.URL)
+				}
+
+				page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+				page = Max(page, 1)
+				requested = append(requested, page)
+
+				if page < tt.pages {
+					tt.paginate(w, r, page)
+				}
+				fmt.Fprintf(w, `[{"page":%d},{"page":%d}]`, page, page)
+			}))
+			defer srv.Close()
+
+			body, err := newTestGL(t, srv).getAll(srv.URL + "/api/v4/items")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want, wantRequested []int
+			for page := 1; page <= tt.pages; page++ {
+				want = append(want, page, page)
+				wantRequested = append(wantRequested, page)
+			}
+			if got := decodePages(t, body); !reflect.DeepEqual(got, want) {
+				t.Errorf("getAll() items from pages %v, want %v", got, want)
+			}
+			if !reflect.DeepEqual(requested, wantRequested) {
+				t.Errorf("Requested pages %v, want %v", requested, wantRequested)
+			}
+		})
+	}
+}
+
+// A later page which hasn't changed since it was cached comes back as a 304,
+// and both its items and the headers pointing on to the next page must come
+// from the cache.
+func TestGetAllNotModifiedLaterPage(t *testing.T) {
+	var mu sync.Mutex
+	version := 1
+	notModified := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		page = Max(page, 1)
+
+		// Only page 2 stays the same between fetches
+		etag := fmt.Sprintf(`"%d-%d"`, page, version)
+		if page == 2 {
+			etag = `"2"`
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		if page < 3 {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		}
+		fmt.Fprintf(w, `[{"page":%d}]`, page*10+version)
+	}))
+	defer srv.Close()
+
+	gl := newTestGL(t, srv)
+	first, err := gl.getAll(srv.URL + "/api/v4/items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decodePages(t, first), []int{11, 21, 31}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("First getAll() = %v, want %v", got, want)
+	}
+
+	mu.Lock()
+	version = 2
+	mu.Unlock()
+
+	second, err := gl.getAll(srv.URL + "/api/v4/items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decodePages(t, second), []int{12, 21, 32}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Second getAll() = %v, want %v", got, want)
+	}
+	if notModified != 1 {
+		t.Errorf("Server sent %d 304 responses, want 1", notModified)
+	}
+}
+
+func TestNoteRenderWidth(t *testing.T) {
+	tests := []struct {
+		name   string
+		author string
+		body   string
+		// Rows for the author, rule, body and blank line at the end
+		rows int
+	}{
+		{"ascii", "Ann", "Looks good", 4},
+		{"cjk", "张伟", "漢字漢字", 4},
+		{"combining marks", "Zoe\u0308", "cafe\u0301 cre\u0300me", 4},
+		{"emoji zwj", "Ann", "family " + zwjFamily + " here", 4},
+		{"tabs", "Ann", "a\tb\tc", 4},
+		{"multiple lines", "Ann", "one\ntwo\nthree", 6},
+		{"wrapped", "Ann", strings.Repeat("word ", 10), 5},
+		{"wrapped cjk", "Ann", strings.Repeat("漢", 30), 6},
+		{"wrapped zwj", "Ann", strings.Repeat(zwjFamily, 30), 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			note := &GLNote{Author: GLAuthor{Name: tt.author}, Body: tt.body}
+			vp := &ViewParams{width: 40, lineNoColWidth: 3}
+
+			for _, cursor := range []bool{false, true} {
+				rendered := note.Render(vp, cursor)
+				lines := strings.Split(rendered, "\n")
+				if len(lines) != tt.rows {
+					t.Errorf("Rendered %d rows, want %d: %q", len(lines), tt.rows, rendered)
+				}
+				if note.Height(vp) != len(lines) {
+					t.Errorf("Height() = %d, but rendered %d rows", note.Height(vp), len(lines))
+				}
+
+				for _, line := range lines {
+					if got := cellWidth(stripANSI(line)); got != vp.width {
+						t.Errorf("Row %q is %d cells wide, want %d", stripANSI(line), got, vp.width)
+					}
+				}
+			}
+		})
+	}
+}
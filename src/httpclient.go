@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+	maxRetries     = 4
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+type GLHTTPError struct {
+	Method     string
+	Url        string
+	StatusCode int
+}
+
+func (e *GLHTTPError) Error() string {
+	return fmt.Sprintf("Request to %s failed with status code %d", e.Url, e.StatusCode)
+}
+
+// Shared by every request made through a GLInstance: one client so
+// connections are reused, a semaphore so the loader workers (and anything
+// else) don't hammer the server, and a pause for when we've been told we're
+// out of rate limit budget.
+type glTransport struct {
+	client  *http.Client
+	limiter chan struct{}
+
+	mu         sync.Mutex
+	pauseUntil time.Time
+}
+
+func newGLTransport(maxConcurrent int) *glTransport {
+	return &glTransport{
+		client:  &http.Client{Timeout: requestTimeout},
+		limiter: make(chan struct{}, maxConcurrent),
+	}
+}
+
+func (t *glTransport) waitForBudget() {
+	t.mu.Lock()
+	wait := time.Until(t.pauseUntil)
+	t.mu.Unlock()
+
+	if wait > 0 {
+		log.Info().Dur("wait", wait).Msg("Rate limit exhausted, pausing requests.")
+		time.Sleep(wait)
+	}
+}
+
+func (t *glTransport) pauseFor(wait time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	until := time.Now().Add(wait)
+	if until.After(t.pauseUntil) {
+		t.pauseUntil = until
+	}
+}
+
+// Performs a request, retrying with exponential backoff on connection
+// errors, 5xx and 429 responses. Anything other than a 2xx (or a 304, which
+// callers that send conditional requests expect) is returned as a
+// *GLHTTPError. prepare, if given, is applied to every attempt's request.
+func (gl *GLInstance) do(method string, url string, body []byte, prepare func(*http.Request)) (*http.Response, []byte, error) {
+	t := gl.transport
+	// Non-idempotent requests may have taken effect even if we never saw the
+	// response, so they're only retried when the server says it refused them.
+	idempotent := method == "GET" || method == "HEAD" || method == "DELETE"
+
+	for attempt := 0; ; attempt++ {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+
+		req, err := gl.authdReq(method, url, reqBody)
+		if err != nil {
+			log.Error().Str("url", url).Str("method", method).Msg("Error building request.")
+			return nil, nil, err
+		}
+		if prepare != nil {
+			prepare(req)
+		}
+
+		t.waitForBudget()
+		t.limiter <- struct{}{}
+		resp, err := t.client.Do(req)
+		var respBody []byte
+		if err == nil {
+			respBody, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		<-t.limiter
+
+		if err == nil {
+			t.noteRateLimit(resp)
+		}
+
+		retryable := false
+		if err != nil {
+			retryable = idempotent
+		} else if resp.StatusCode == http.StatusTooManyRequests {
+			retryable = true
+		} else if resp.StatusCode >= 500 {
+			retryable = idempotent
+		}
+
+		if retryable && attempt < maxRetries {
+			delay := retryDelay(resp, attempt)
+			log.Warn().
+				Err(err).
+				Str("url", url).
+				Str("method", method).
+				Int("attempt", attempt+1).
+				Dur("delay", delay).
+				Msg("Request failed, retrying.")
+			time.Sleep(delay)
+			continue
+		}
+
+		if err != nil {
+			log.Error().Err(err).Str("url", url).Str("method", method).Msg("Error conducting request.")
+			return nil, nil, err
+		}
+
+		if resp.StatusCode != http.StatusNotModified && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			log.Error().
+				Str("url", url).
+				Str("method", method).
+				Int("code", resp.StatusCode).
+				Msg("Non-2xx status code when executing request.")
+			return nil, nil, &GLHTTPError{Method: method, Url: url, StatusCode: resp.StatusCode}
+		}
+
+		return resp, respBody, nil
+	}
+}
+
+// GitLab reports how much of the rate limit is left on every response. Once
+// it runs out, hold off all requests until the window resets.
+func (t *glTransport) noteRateLimit(resp *http.Response) {
+	if resp.Header.Get("RateLimit-Remaining") != "0" {
+		return
+	}
+
+	reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	wait := time.Until(time.Unix(reset, 0))
+	if wait > 0 {
+		t.pauseFor(MinDuration(wait, retryMaxDelay))
+	}
+}
+
+// How long to wait before retrying. Honours Retry-After (in either of its
+// forms) when the server sends it, otherwise backs off exponentially with
+// some jitter so the workers don't retry in lockstep.
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	if resp != nil {
+		retryAfter := resp.Header.Get("Retry-After")
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return MinDuration(time.Duration(seconds)*time.Second, retryMaxDelay)
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			return MinDuration(MaxDuration(time.Until(at), 0), retryMaxDelay)
+		}
+	}
+
+	delay := retryBaseDelay << attempt
+	delay += time.Duration(rand.Int63n(int64(delay) / 2))
+	return MinDuration(delay, retryMaxDelay)
+}
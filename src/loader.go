@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	gloss "github.com/charmbracelet/lipgloss"
+	"time"
+)
+
+type CreateFileRegionMsg struct {
+	idx    int
+	pid    string
+	ref    string
+	change GLChangeData
+}
+
+// Sent by the loader workers as each file becomes ready. Files are queued in
+// order, so regions tend to arrive roughly top to bottom.
+type FileRegionLoadedMsg struct {
+	idx    int
+	region VRegion
+	err    error
+	// What the region was laid out with
+	settings viewSettings
+}
+
+// Stands in for a FileRegion whose contents are still being fetched and
+// highlighted. It only ever occupies a single header-like line.
+type PlaceholderRegion struct {
+	path string
+	err  error
+}
+
+func (p *PlaceholderRegion) Height() int {
+	return 1
+}
+
+func (p *PlaceholderRegion) HandleAction(m *Model, action string, cursor int) (tea.Model, tea.Cmd) {
+	return m, nil
+}
+
+func (p *PlaceholderRegion) GetRowType(cursor int) int {
+	return FRHeader
+}
+
+func (p *PlaceholderRegion) Resize(m *Model) {}
+
+func (p *PlaceholderRegion) View(startLine int, numLines int, cursor int, m *Model) string {
+	if numLines < 1 {
+		return ""
+	}
+
+	status := "loading..."
+	fg := gloss.Color("#AAA")
+	if p.err != nil {
+		status = fmt.Sprintf("failed to load: %s", p.err)
+		fg = gloss.Color("#F44")
+	}
+
+	headerBg := gloss.Color("#555")
+	if cursor == 0 {
+		headerBg = gloss.Color("#777")
+	}
+
+	return gloss.NewStyle().
+		Width(m.w).
+		MaxWidth(m.w).
+		Background(headerBg).
+		Foreground(fg).
+		Render(fmt.Sprintf(" … %s (%s)", p.path, status))
+}
+
+func (p *PlaceholderRegion) StickyRows(startLine int) int {
+	return 0
+}
+
+func (p *PlaceholderRegion) GetNextCursorTarget(lineNo int, direction int) int {
+	return 0
+}
+
+func (p *PlaceholderRegion) SetECState(value bool) {}
+
+func (p *PlaceholderRegion) GetPendingComments() []Comment {
+	return nil
+}
+
+func (p *PlaceholderRegion) Highlight() tea.Cmd {
+	return nil
+}
+
+func (p *PlaceholderRegion) GetAnchor(cursor int) Anchor {
+	return Anchor{objType: FRHeader}
+}
+
+func (p *PlaceholderRegion) ResolveAnchor(anchor Anchor) int {
+	return 0
+}
+
+func newPlaceholderRegions(changes []GLChangeData) []VRegion {
+	regions := make([]VRegion, len(changes))
+	for idx, change := range changes {
+		regions[idx] = &PlaceholderRegion{path: change.NewPath}
+	}
+
+	return regions
+}
+
+// Partitions the notes on lines of the diff by the file they're on.
+func diffNotesByFile(discussions []GLDiscussion) map[string]([]Comment) {
+	notesByFile := make(map[string]([]Comment))
+	for _, discussion := range discussions {
+		for _, note := range discussion.Notes {
+			note := note
+			if note.Type == "DiffNote" {
+				path := note.Position.NewPath
+				notesByFile[path] = append(notesByFile[path], &note)
+			}
+		}
+	}
+
+	return notesByFile
+}
+
+// Fetches and formats every changed file in the MR using a small pool of
+// workers. Results are delivered on the returned channel, which is closed
+// once every file has been handled.
+func loadFileRegions(gl *GLInstance, pid string, mrData *GLMRData, vp ViewParams) <-chan FileRegionLoadedMsg {
+	notesByFile := diffNotesByFile(mrData.Discussions)
+
+	q := make(chan CreateFileRegionMsg, 8)
+	results := make(chan FileRegionLoadedMsg, len(mrData.Changes))
+	done := make(chan struct{})
+
+	for i := 0; i < CFG.Workers; i++ {
+		go func() {
+			for msg := range q {
+				region, err := loadFileRegion(gl, msg, notesByFile[msg.change.NewPath], vp)
+				results <- FileRegionLoadedMsg{
+					idx:      msg.idx,
+					region:   region,
+					err:      err,
+					settings: vp.settings,
+				}
+			}
+			done <- struct{}{}
+		}()
+	}
+
+	go func() {
+		for idx, change := range mrData.Changes {
+			q <- CreateFileRegionMsg{
+				idx:    idx,
+				pid:    pid,
+				change: change,
+				ref:    mrData.DiffRefs.BaseSHA,
+			}
+		}
+		close(q)
+
+		for i := 0; i < CFG.Workers; i++ {
+			<-done
+		}
+		close(results)
+	}()
+
+	return results
+}
+
+func loadFileRegion(gl *GLInstance, msg CreateFileRegionMsg, comments []Comment, vp ViewParams) (VRegion, error) {
+	var baseContent string
+
+	if !msg.change.NewFile {
+		fetchedContent, err := fetchFileContents(
+			gl,
+			msg.pid,
+			msg.change.OldPath,
+			msg.ref,
+		)
+		if err != nil {
+			return nil, err
+		}
+		baseContent = fetchedContent
+	}
+
+	ff, err := FormatFile(baseContent, msg.change)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFileRegion(ff, msg.change, comments, vp), nil
+}
+
+// Sent once every file has been loaded.
+type FileRegionsDoneMsg struct{}
+
+// Produces a command which waits for the next loaded region. Once the loader
+// is exhausted the command yields FileRegionsDoneMsg and is not rescheduled.
+func waitForFileRegion(results <-chan FileRegionLoadedMsg) tea.Cmd {
+	return func() tea.Msg {
+		msg, ok := <-results
+		if !ok {
+			return FileRegionsDoneMsg{}
+		}
+		return msg
+	}
+}
+
+// The result of recomputing one file's diff locally. ff is nil when going
+// back to GitLab's diff.
+type rebuiltDiff struct {
+	region *FileRegion
+	ff     *FormattedFile
+	err    error
+}
+
+type DiffsRebuiltMsg struct {
+	opts    DiffOptions
+	results []rebuiltDiff
+}
+
+// Recomputes the diffs of regions in the background according to opts. Both
+// sides of each file are needed, which are usually already in the HTTP cache
+// (or the local clone) since they're fetched by commit.
+func (m Model) rebuildDiffs(regions []*FileRegion, opts DiffOptions) tea.Cmd {
+	gl, pid := m.gl, m.initData.project
+	refs := make(map[*FileRegion]GLDiffRefs)
+	for _, region := range regions {
+		refs[region] = m.refsOf(region)
+	}
+
+	return func() tea.Msg {
+		msg := DiffsRebuiltMsg{opts: opts}
+		results := make(chan rebuiltDiff, len(regions))
+		work := make(chan *FileRegion)
+
+		for i := 0; i < CFG.Workers; i++ {
+			go func() {
+				for region := range work {
+					results <- rebuildDiff(gl, pid, refs[region], region, opts)
+				}
+			}()
+		}
+		for _, region := range regions {
+			work <- region
+		}
+		close(work)
+
+		for range regions {
+			msg.results = append(msg.results, <-results)
+		}
+
+		return msg
+	}
+}
+
+// Switches every loaded file over to diffs computed with opts.
+func (m Model) setDiffOptions(opts DiffOptions, status string) (tea.Model, tea.Cmd) {
+	if opts == m.diffOpts {
+		return m.displayStatusMessage(status, 3*time.Second)
+	}
+
+	// Both of these mean GitLab's diff, so there's nothing to do
+	if !opts.Active() && !m.diffOpts.Active() {
+		m.diffOpts = opts
+		return m.displayStatusMessage(status, 3*time.Second)
+	}
+	m.diffOpts = opts
+
+	var regions []*FileRegion
+	for _, region := range m.regions {
+		if fr, ok := region.(*FileRegion); ok {
+			regions = append(regions, fr)
+		}
+	}
+
+	next, statusCmd := m.displayStatusMessage(status, 3*time.Second)
+	return next, tea.Batch(statusCmd, m.rebuildDiffs(regions, opts))
+}
+
+func (m Model) applyRebuiltDiffs(msg DiffsRebuiltMsg) (tea.Model, tea.Cmd) {
+	// Toggled again before this lot finished
+	if msg.opts != m.diffOpts {
+		return m, nil
+	}
+
+	anchor := m.anchorCursor()
+	failed := 0
+	for _, result := range msg.results {
+		if result.err != nil {
+			failed++
+			continue
+		}
+
+		result.region.SetDiff(result.ff, m.viewParams(0))
+	}
+	(&m).restoreCursor(anchor)
+	(&m).clampCursor()
+
+	// The MR's moves are found once all of its files are in
+	var cmd tea.Cmd
+	if m.viewedCommit != nil || m.loader == nil {
+		cmd = m.detectMoves(m.regions)
+	}
+
+	if failed > 0 {
+		next, statusCmd := m.displayStatusMessage(
+			fmt.Sprintf("ERR: Unable to recompute the diff of %d files.", failed),
+			3*time.Second,
+		)
+		return next, tea.Batch(cmd, statusCmd)
+	}
+
+	return m, cmd
+}
+
+func rebuildDiff(gl *GLInstance, pid string, refs GLDiffRefs, region *FileRegion, opts DiffOptions) rebuiltDiff {
+	result := rebuiltDiff{region: region}
+	if !opts.Active() {
+		return result
+	}
+
+	change := GLChangeData{
+		OldPath:     region.oldPath,
+		NewPath:     region.newPath,
+		NewFile:     region.added,
+		DeletedFile: region.removed,
+	}
+	result.ff, result.err = formatRevisions(gl, pid, change, refs.BaseSHA, refs.HeadSHA, opts)
+	if result.ff != nil && len(result.ff.lines) == 0 {
+		// Nothing to show either way, e.g. an empty file being added
+		result.ff = nil
+	}
+
+	return result
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reads path as of ref from CFG.LocalClone, if one is configured. ok is false
+// when there's no clone or it doesn't have ref, e.g. because it hasn't been
+// fetched recently.
+func readLocalFile(path string, ref string) (content string, ok bool) {
+	if CFG.LocalClone == "" || !shaPattern.MatchString(ref) {
+		return "", false
+	}
+
+	out, err := exec.Command("git", "-C", CFG.LocalClone, "show", ref+":"+path).Output()
+	if err != nil {
+		log.Debug().
+			Err(err).
+			Str("path", path).
+			Str("ref", ref).
+			Msg("Unable to read file from local clone, falling back to GitLab.")
+		return "", false
+	}
+
+	return string(out), true
+}
+
+// The path to a file in the local clone's working tree, provided the clone
+// has ref checked out so the file matches what's being reviewed.
+func localCheckoutPath(path string, ref string) (string, bool) {
+	if CFG.LocalClone == "" {
+		return "", false
+	}
+
+	out, err := exec.Command("git", "-C", CFG.LocalClone, "rev-parse", "HEAD").Output()
+	if err != nil || strings.TrimSpace(string(out)) != ref {
+		return "", false
+	}
+
+	fullPath := filepath.Join(CFG.LocalClone, path)
+	if _, err := os.Stat(fullPath); err != nil {
+		return "", false
+	}
+
+	return fullPath, true
+}
+
+// Blames path as of ref in CFG.LocalClone, giving the commit which last
+// changed each line. Only the first line of each commit's message is known.
+func localBlame(path string, ref string) ([]*GLCommit, bool) {
+	if CFG.LocalClone == "" || !shaPattern.MatchString(ref) {
+		return nil, false
+	}
+
+	out, err := exec.Command("git", "-C", CFG.LocalClone, "blame", "--porcelain", ref, "--", path).Output()
+	if err != nil {
+		log.Debug().
+			Err(err).
+			Str("path", path).
+			Str("ref", ref).
+			Msg("Unable to blame file in local clone, falling back to GitLab.")
+		return nil, false
+	}
+
+	return parseBlamePorcelain(string(out)), true
+}
+
+// Each line in `git blame --porcelain` output is introduced by a header
+// naming its commit, followed by details of the commit the first time it
+// appears, then the line itself prefixed with a tab.
+func parseBlamePorcelain(out string) []*GLCommit {
+	var lines []*GLCommit
+	var current *GLCommit
+	commits := make(map[string]*GLCommit)
+
+	for _, line := range strings.Split(out, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			lines = append(lines, current)
+		case shaPattern.MatchString(key):
+			current = commits[key]
+			if current == nil {
+				current = &GLCommit{Id: key}
+				commits[key] = current
+			}
+		case current == nil:
+			continue
+		case key == "author":
+			current.AuthorName = value
+		case key == "author-time":
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+				current.AuthoredDate = time.Unix(seconds, 0).Format(time.RFC3339)
+			}
+		case key == "summary":
+			current.Title = value
+		}
+	}
+
+	return lines
+}
+
+// The full message of commit sha, from CFG.LocalClone.
+func localCommitMessage(sha string) (string, bool) {
+	if CFG.LocalClone == "" {
+		return "", false
+	}
+
+	out, err := exec.Command("git", "-C", CFG.LocalClone, "show", "-s", "--format=%B", sha).Output()
+	if err != nil {
+		return "", false
+	}
+
+	return string(out), true
+}
+
+// Fetches a file's contents from the local clone where possible, otherwise
+// from GitLab. Only commit SHAs are looked up locally since branches in the
+// clone may well be out of date.
+func fetchFileContents(gl *GLInstance, pid string, path string, ref string) (string, error) {
+	if content, ok := readLocalFile(path, ref); ok {
+		return content, nil
+	}
+
+	content, err := gl.FetchFileContents(pid, path, ref)
+	if err != nil {
+		return "", err
+	}
+
+	return *content, nil
+}
+
+// Diffs a file between any two revisions locally. change says which paths to
+// read from each side and whether the file exists on both.
+func formatRevisions(gl *GLInstance, pid string, change GLChangeData, baseRef string, headRef string, opts DiffOptions) (*FormattedFile, error) {
+	var base, head string
+	var err error
+
+	if !change.NewFile {
+		base, err = fetchFileContents(gl, pid, change.OldPath, baseRef)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !change.DeletedFile {
+		head, err = fetchFileContents(gl, pid, change.NewPath, headRef)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return FormatDiff(base, head, change, opts), nil
+}
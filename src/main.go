@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/textinput"
@@ -9,24 +10,14 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"math/rand"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-var bgColorMap = [...]string{
-	"#000",
-	"#040",
-	"#400",
-	"#000",
-	"#444",
-	"#474",
-	"#744",
-}
-
 const (
 	NormalMode int = 0
 	ExMode         = 1
@@ -39,23 +30,47 @@ type ClearStatusMessageMsg struct {
 type LoadMRMsg struct {
 	regions []VRegion
 	mr      GLMRData
-	gl      *GLInstance
+	loader  <-chan FileRegionLoadedMsg
+}
+
+// Sent when the MR can't be loaded at all, which leaves nothing to show.
+type LoadErrorMsg struct {
+	err error
 }
 
 type ViewParams struct {
 	x              int
 	width          int
 	lineNoColWidth int
+	settings       viewSettings
+}
+
+// Display settings which can be changed while glimrr is running. They start
+// out from CFG but are kept on the Model, and background work is handed a
+// copy, so nothing reads them while they're being changed.
+type viewSettings struct {
+	contextLines     int
+	contextThreshold int
+	wrap             bool
+	// One of whitespaceModes
+	showWhitespace string
+	blame          bool
 }
 
 type VRegion interface {
 	Height() int
-	Update(m *Model, msg tea.Msg, cursor int) (tea.Model, tea.Cmd)
+	HandleAction(m *Model, action string, cursor int) (tea.Model, tea.Cmd)
+	GetRowType(cursor int) int
 	Resize(m *Model)
 	View(startLine int, numLines int, cursor int, m *Model) string
 	GetNextCursorTarget(lineNo int, direction int) int
+	// Rows at the top which stay put while the rest of the region scrolls
+	StickyRows(startLine int) int
 	SetECState(value bool)
 	GetPendingComments() []Comment
+	Highlight() tea.Cmd
+	GetAnchor(cursor int) Anchor
+	ResolveAnchor(anchor Anchor) int
 }
 
 type StatusMessage struct {
@@ -82,12 +97,49 @@ type Model struct {
 	mr          GLMRData
 	spinner     spinner.Model
 	exInput     textinput.Model
+	exHistory   *exHistory
+	exComplete  *exCompletion
 	regions     []VRegion
+	loader      <-chan FileRegionLoadedMsg
+	headSHA     string
+	refreshing  bool
+	fatalErr    error
+	pendingKeys []string
+	// A count typed before a key sequence, 0 if there isn't one
+	count int
+	// An action waiting for a key to use as its argument, see set_mark
+	awaitingArg string
+	marks       map[string]cursorAnchor
+	selection   *lineSelection
+	overlay     *Overlay
+	diffOpts    DiffOptions
+	settings    viewSettings
 	messages    []StatusMessage
 	p           *tea.Program
+	// The MR's commits oldest first, once they've been listed
+	commits []GLCommit
+	// The commit being reviewed on its own, nil while showing the whole MR
+	viewedCommit *GLCommit
+	// The whole MR's regions and cursor, set aside while a commit is shown
+	mrRegions []VRegion
+	mrCursor  cursorAnchor
 }
 
 func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	next, cmd := m.update(msg)
+
+	// Whatever happened may have brought unhighlighted files into view
+	switch nm := next.(type) {
+	case Model:
+		return nm, tea.Batch(cmd, nm.highlightNearViewport())
+	case *Model:
+		return nm, tea.Batch(cmd, nm.highlightNearViewport())
+	}
+
+	return next, cmd
+}
+
+func (m Model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 
 	switch msg := msg.(type) {
@@ -95,6 +147,8 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.w = msg.Width
 		m.h = msg.Height
 		m.exInput.Width = msg.Width
+		// Wrapped lines and comments take up a different number of rows
+		(&m).relayout()
 	case EndLoadingMsg:
 		m.loadingText = ""
 	case ClearStatusMessageMsg:
@@ -113,10 +167,79 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.loadingText = ""
 		m.regions = msg.regions
 		m.mr = msg.mr
-		m.gl = msg.gl
+		m.loader = msg.loader
+		m.headSHA = msg.mr.DiffRefs.HeadSHA
 		for _, region := range m.regions {
 			region.Resize(&m)
 		}
+		return m, tea.Batch(waitForFileRegion(m.loader), scheduleRefresh(), m.loadCommits())
+	case LoadErrorMsg:
+		m.fatalErr = msg.err
+		return m, tea.Quit
+	case FileRegionLoadedMsg:
+		cmd = waitForFileRegion(m.loader)
+		if msg.err != nil {
+			placeholder := m.mrRegionList()[msg.idx].(*PlaceholderRegion)
+			placeholder.err = msg.err
+			model, statusCmd := m.displayStatusMessage(
+				fmt.Sprintf("ERR: Unable to load %s.", placeholder.path),
+				3*time.Second,
+			)
+			return model, tea.Batch(cmd, statusCmd)
+		}
+
+		if fr, ok := msg.region.(*FileRegion); ok {
+			// The file started loading with the settings and discussions as
+			// they were then, and either may have changed since
+			vp := m.viewParams(fr.lineNoColWidth)
+			if vp.settings != msg.settings {
+				fr.SetContext(vp)
+			}
+			fr.MergeComments(diffNotesByFile(m.mr.Discussions)[fr.newPath], vp)
+		}
+		if m.viewedCommit != nil {
+			// The MR's files are set aside while a commit is shown
+			msg.region.Resize(&m)
+			m.mrRegions[msg.idx] = msg.region
+		} else {
+			(&m).replaceRegion(msg.idx, msg.region)
+		}
+		if fr, ok := msg.region.(*FileRegion); ok {
+			if m.diffOpts.Active() {
+				cmd = tea.Batch(cmd, m.rebuildDiffs([]*FileRegion{fr}, m.diffOpts))
+			}
+			if m.settings.blame {
+				cmd = tea.Batch(cmd, m.loadBlame([]*FileRegion{fr}))
+			}
+		}
+		return m, cmd
+	case FileRegionsDoneMsg:
+		m.loader = nil
+		return m, m.detectMoves(m.mrRegionList())
+	case MovesDetectedMsg:
+		return m.applyMoves(msg)
+	case DiffsRebuiltMsg:
+		return m.applyRebuiltDiffs(msg)
+	case BlameLoadedMsg:
+		return m.applyBlame(msg)
+	case CommitsLoadedMsg:
+		return m.applyCommits(msg)
+	case CommentsSubmittedMsg:
+		return m.applySubmitted(msg)
+	case CommentDeletedMsg:
+		return m.applyDeleted(msg)
+	case CommitLoadedMsg:
+		return m.applyCommit(msg)
+	case FileHighlightedMsg:
+		msg.ff.ApplyHighlight(msg)
+		return m, nil
+	case RefreshTickMsg:
+		if m.refreshing {
+			return m, scheduleRefresh()
+		}
+		return m.startRefresh(false)
+	case RefreshMsg:
+		return m.finishRefresh(msg)
 	}
 
 	if m.loadingText != "" {
@@ -134,48 +257,21 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 func (m Model) nUpdate(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
-		switch msg.String() {
-		case "ctrl+c", "q":
-			return m, tea.Quit
-
-		case "up", "k":
-			(&m).moveCursor(-1)
-
-			if m.cursor < m.y {
-				m.y = m.cursor
-			}
+		if m.overlay != nil {
+			m.overlay = nil
+			return m, nil
+		}
 
-		case "down", "j":
-			(&m).moveCursor(1)
-			if m.cursor >= m.y+m.h {
-				m.y = m.cursor - m.h + 1
+		return m.handleKey(msg)
+	case tea.MouseMsg:
+		if m.overlay != nil {
+			if msg.Type == tea.MouseLeft {
+				m.overlay = nil
 			}
-
-		case "G":
-			totalHeight := m.totalHeight()
-			m.y = totalHeight - m.h
-			m.cursor = totalHeight - 1
-		case "ctrl+d":
-			totalHeight := m.totalHeight()
-			m.y = Min(m.y+(m.h+1)/2, totalHeight-m.h)
-			(&m).moveCursor((m.h + 1) / 2)
-		case "ctrl+u":
-			m.y = Max(m.y-m.h/2, 0)
-			(&m).moveCursor(-(m.h + 1) / 2)
-		case ":":
-			m.exInput = textinput.New()
-			m.exInput.Focus()
-			m.exInput.Prompt = ":"
-			m.exInput.Width = m.w
-
-			m.mode = ExMode
-		default:
-			region, relCursor := m.getCursorTarget(m.cursor)
-			return region.Update(&m, msg, relCursor)
+			return m, nil
 		}
-	default:
-		region, relCursor := m.getCursorTarget(m.cursor)
-		return region.Update(&m, msg, relCursor)
+
+		return m.handleMouse(msg)
 	}
 
 	return m, nil
@@ -189,52 +285,56 @@ func (m Model) eUpdate(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch msg.String() {
 		case "ctrl+c", "esc":
 			m.exInput.SetValue("")
+			m.exComplete = nil
 			m.mode = NormalMode
+			return m, nil
 		case "enter":
-			eCmd := m.exInput.Value()
+			input := m.exInput.Value()
 			m.exInput.SetValue("")
+			m.exComplete = nil
 			m.mode = NormalMode
+			m.exHistory.Add(strings.TrimSpace(input))
 
-			if eCmd == "q" || eCmd == "quit" {
-				return m, tea.Quit
+			eCmd, err := parseExCommand(input)
+			if len(eCmd) == 0 && err == nil {
+				return m, nil
 			}
 
-			if eCmd == "CollapseAll" {
-				for _, region := range m.regions {
-					region.SetECState(true)
-				}
+			var spec *actionSpec
+			if err == nil {
+				spec, err = resolveCommand(eCmd[0])
+			}
+			if err != nil {
+				return m.displayStatusMessage(
+					fmt.Sprintf("ERR: %s.", err),
+					3*time.Second,
+				)
 			}
 
-			if eCmd == "ExpandAll" {
-				for _, region := range m.regions {
-					region.SetECState(false)
-				}
+			return m.runAction(spec.name, eCmd[1:])
+		case "tab", "shift+tab":
+			step := 1
+			if msg.String() == "shift+tab" {
+				step = -1
 			}
 
-			if eCmd == "Load" {
-				return m.doBlockingLoad("Loading stuff...", func() tea.Msg {
-					time.Sleep(3 * time.Second)
-					return nil
-				})
+			if m.exComplete == nil || m.exComplete.value != m.exInput.Value() {
+				m.exComplete = m.completeEx(m.exInput.Value())
+			}
+			if m.exComplete != nil {
+				m.exInput.SetValue(m.exComplete.advance(step))
+				m.exInput.CursorEnd()
 			}
-			if eCmd == "Submit" {
-				return m.doBlockingLoad("Submitting review...", func() tea.Msg {
-					for _, region := range m.regions {
-						for _, comment := range region.GetPendingComments() {
-							note := comment.(*GLNote)
-							m.gl.CreateComment(*note, m.mr)
-						}
-					}
-					m.gl.InvalidateCache()
-
-					return nil
-				})
+			return m, nil
+		case "up", "down":
+			direction := -1
+			if msg.String() == "down" {
+				direction = 1
 			}
 
-			return m.displayStatusMessage(
-				"ERR: Unrecognized command.",
-				3*time.Second,
-			)
+			m.exInput.SetValue(m.exHistory.Step(direction, m.exInput.Value()))
+			m.exInput.CursorEnd()
+			return m, nil
 		}
 	}
 
@@ -288,6 +388,14 @@ func (m Model) View() string {
 		Msg("Rendering...")
 	background := CFG.Colors.Background
 
+	if m.overlay != nil {
+		return gloss.NewStyle().
+			Width(m.w).
+			Height(m.h).
+			Background(background).
+			Render(m.overlay.View(m.w, m.h))
+	}
+
 	if m.loadingText != "" {
 		return gloss.NewStyle().
 			Width(m.w).
@@ -299,17 +407,11 @@ func (m Model) View() string {
 	}
 
 	var parts []string
-	// target height for normal region rendering (ex mode input is the exception)
-	tH := m.h
+	// target height for normal region rendering
+	tH := m.viewHeight()
 	// Height of accumulated rendering, so we know when to should stop
 	cumY := 0
 
-	if m.mode == ExMode {
-		tH -= 1
-	}
-
-	tH -= len(m.messages)
-
 	for _, region := range m.regions {
 		rH := region.Height()
 
@@ -370,6 +472,134 @@ func (m Model) getCursorTarget(cursor int) (VRegion, int) {
 	panic("Unable to find the region the curor is currently in")
 }
 
+// Swaps the region at idx for a newly loaded one, keeping the cursor on the
+// same line if it sits in a region further down.
+func (m *Model) replaceRegion(idx int, region VRegion) {
+	start := 0
+	for _, r := range m.regions[:idx] {
+		start += r.Height()
+	}
+
+	oldHeight := m.regions[idx].Height()
+	region.Resize(m)
+	m.regions[idx] = region
+	delta := region.Height() - oldHeight
+
+	if m.cursor > start {
+		m.cursor += delta
+		if start < m.y {
+			m.y += delta
+		}
+		if h := m.viewHeight(); m.cursor >= m.y+h {
+			m.y = m.cursor - h + 1
+		}
+	}
+}
+
+// Starts highlighting regions within a screen's height of the viewport.
+func (m Model) highlightNearViewport() tea.Cmd {
+	var cmds []tea.Cmd
+	cumY := 0
+
+	for _, region := range m.regions {
+		rH := region.Height()
+
+		if cumY > m.y+2*m.h {
+			break
+		}
+
+		if cumY+rH >= m.y-m.h {
+			cmds = append(cmds, region.Highlight())
+		}
+		cumY += rH
+	}
+
+	return tea.Batch(cmds...)
+}
+
+// Pulls the cursor back within bounds after regions shrink.
+func (m *Model) clampCursor() {
+	totalHeight := m.totalHeight()
+	m.cursor = Clamp(0, m.cursor, totalHeight-1)
+	m.y = Clamp(0, m.y, Max(totalHeight-m.h, 0))
+	m.scrollToCursor()
+}
+
+// Rows available for regions, after the status messages and ex input.
+func (m Model) viewHeight() int {
+	h := m.h - len(m.messages)
+	if m.mode == ExMode {
+		h -= 1
+	}
+
+	return Max(h, 1)
+}
+
+// Parameters for laying out a region whose line numbers take lineNoColWidth.
+func (m Model) viewParams(lineNoColWidth int) *ViewParams {
+	return &ViewParams{
+		x:              m.x,
+		width:          m.w,
+		lineNoColWidth: lineNoColWidth,
+		settings:       m.settings,
+	}
+}
+
+// Scrolls the minimum amount needed to bring the cursor on screen, without
+// leaving it underneath the sticky rows of a partially scrolled region.
+func (m *Model) scrollToCursor() {
+	if m.cursor >= m.y+m.viewHeight() {
+		m.y = m.cursor - m.viewHeight() + 1
+	}
+	if m.cursor < m.y {
+		m.y = m.cursor
+	}
+
+	for m.y > 0 && m.cursor < m.y+m.stickyRows() {
+		m.y--
+	}
+}
+
+// Lays every region out again for the current width and options, keeping
+// the cursor where it was.
+func (m *Model) relayout() {
+	if len(m.regions) == 0 {
+		return
+	}
+
+	anchor := m.anchorCursor()
+	for _, region := range m.regions {
+		region.Resize(m)
+	}
+	m.restoreCursor(anchor)
+	m.clampCursor()
+	m.scrollX(m.x)
+}
+
+// Scrolls lines horizontally to x, as far as there's anything to see.
+func (m *Model) scrollX(x int) {
+	maxX := 0
+	if !m.settings.wrap {
+		for _, region := range m.regions {
+			if fr, ok := region.(*FileRegion); ok {
+				maxX = Max(maxX, fr.maxScrollX(m.viewParams(fr.lineNoColWidth)))
+			}
+		}
+	}
+
+	m.x = Clamp(0, x, maxX)
+}
+
+// How many rows at the top of the screen are taken up by sticky rows.
+func (m Model) stickyRows() int {
+	if len(m.regions) == 0 {
+		return 0
+	}
+
+	region, startLine := m.getCursorTarget(m.y)
+	return region.StickyRows(startLine)
+}
+
 func (m Model) totalHeight() int {
 	h := 0
 	for _, region := range m.regions {
@@ -385,94 +615,32 @@ func (m Model) Init() tea.Cmd {
 	return tea.Batch(
 		m.spinner.Tick,
 		func() tea.Msg {
-			gl := GLInstance{apiUrl: fmt.Sprintf("%s/api", m.initData.glHost)}
-			gl.Init()
-
-			mrData, err := gl.FetchMR(m.initData.project, m.initData.mrid)
+			mrData, err := m.gl.FetchMR(m.initData.project, m.initData.mrid)
 			if err != nil {
-				panic(err)
-			}
-
-			regions := make([]VRegion, len(mrData.Changes))
-
-			// Partion notes by file that they apply to
-			notesByFile := make(map[string]([]Comment))
-			for _, discussion := range mrData.Discussions {
-				for _, note := range discussion.Notes {
-					note := note
-					if note.Type == "DiffNote" {
-						path := note.Position.NewPath
-						notesByFile[path] = append(notesByFile[path], &note)
-					}
-				}
-			}
-			var wg sync.WaitGroup
-
-			q := make(chan CreateFileRegionMsg, 8)
-
-			for i := 0; i < 4; i++ {
-				wg.Add(1)
-				go func() {
-					for msg := range q {
-						var baseContent string
-
-						if !msg.change.NewFile {
-							fetchedContent, err := gl.FetchFileContents(
-								msg.pid,
-								msg.change.OldPath,
-								msg.ref,
-							)
-							if err != nil {
-								panic(err)
-							}
-							baseContent = *fetchedContent
-						} else {
-							baseContent = ""
-						}
-
-						ff, err := FormatFile(baseContent, msg.change)
-						if err != nil {
-							panic(err)
-						}
-
-						var comments []Comment
-						var ok bool
-						if comments, ok = notesByFile[msg.change.NewPath]; !ok {
-							comments = nil
-						}
-
-						regions[msg.idx] = newFileRegion(ff, msg.change, comments, m.w)
-					}
-					wg.Done()
-				}()
-
-			}
-
-			for idx, change := range mrData.Changes {
-				q <- CreateFileRegionMsg{
-					idx:    idx,
-					pid:    m.initData.project,
-					change: change,
-					ref:    mrData.DiffRefs.BaseSHA,
-				}
+				return LoadErrorMsg{err: describeLoadError(err, m.gl)}
 			}
-			close(q)
-			wg.Wait()
 
 			return LoadMRMsg{
-				regions: regions,
+				regions: newPlaceholderRegions(mrData.Changes),
 				mr:      *mrData,
-				gl:      &gl,
+				loader:  loadFileRegions(m.gl, m.initData.project, mrData, *m.viewParams(0)),
 			}
 		},
 	)
 }
 
-type CreateFileRegionMsg struct {
-	idx    int
-	pid    string
-	ref    string
-	change GLChangeData
+// Turns auth failures into something that tells the user what to fix.
+func describeLoadError(err error, gl *GLInstance) error {
+	var httpErr *GLHTTPError
+	if errors.As(err, &httpErr) && (httpErr.StatusCode == 401 || httpErr.StatusCode == 403) {
+		return fmt.Errorf(
+			"GitLab rejected the token from %s (status %d). Check that it is valid, unexpired and has the api scope.",
+			gl.cred.Source,
+			httpErr.StatusCode,
+		)
+	}
+
+	return fmt.Errorf("Unable to load merge request: %w", err)
 }
 
 //var logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
@@ -498,17 +666,6 @@ func main() {
 
 	log.Debug().Msg("Glimmr starting...")
 
-	homeDir, err := os.UserHomeDir()
-	if err == nil {
-		configPath := fmt.Sprintf("%s/.config/glimrr/config.json", homeDir)
-		log.Debug().Msg(fmt.Sprintf("Attempting to read config from %s", configPath))
-		userConfig, err := loadConfigFromFile(configPath)
-		CFG = userConfig
-		if err != nil {
-			log.Info().Msg("Unable to load user config, using defaults.")
-		}
-	}
-
 	model := Model{
 		loadingText: "Loading MR...",
 		h:           24,
@@ -539,15 +696,64 @@ func main() {
 		mrid:    mrid,
 	}
 
+	homeDir, err := os.UserHomeDir()
+	if err == nil {
+		configPath := fmt.Sprintf("%s/.config/glimrr/config.json", homeDir)
+		log.Debug().Msg(fmt.Sprintf("Attempting to read config from %s", configPath))
+		userConfig, err := loadConfigFromFile(configPath, model.initData.project)
+		CFG = userConfig
+
+		var configErr *ConfigError
+		if errors.As(err, &configErr) {
+			fmt.Fprintln(os.Stderr, configErr)
+			os.Exit(2)
+		} else if err != nil {
+			log.Info().Msg("Unable to load user config, using defaults.")
+		}
+	}
+
+	model.diffOpts = DiffOptions{Algorithm: CFG.Diff.Algorithm}
+	model.settings = viewSettings{
+		contextLines:     CFG.Context.Lines,
+		contextThreshold: CFG.Context.Threshold,
+		wrap:             CFG.Wrap,
+		showWhitespace:   CFG.Whitespace.Show,
+		blame:            CFG.Blame,
+	}
+
+	hostUrl, _ := url.Parse(model.initData.glHost)
+	cred, err := ResolveCredential(hostUrl.Hostname())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	log.Debug().Str("source", cred.Source).Msg("Resolved credentials.")
+
+	model.gl = &GLInstance{
+		apiUrl: fmt.Sprintf("%s/api", model.initData.glHost),
+		cred:   cred,
+	}
+	model.gl.Init()
+
 	// This doesn't feel great, but we need to call program methods from the
 	// model so *shrug*
 	mp := &model
-	program := tea.NewProgram(mp)
+	var options []tea.ProgramOption
+	if CFG.Behavior.Mouse {
+		options = append(options, tea.WithMouseCellMotion())
+	}
+	program := tea.NewProgram(mp, options...)
 	mp.p = program
 
 	log.Debug().Msg("Handing control of console over to tea.")
-	if err := program.Start(); err != nil {
+	finalModel, err := program.Run()
+	if err != nil {
 		log.Fatal().Err(err).Msg("")
 		os.Exit(1)
 	}
+
+	if fm, ok := finalModel.(Model); ok && fm.fatalErr != nil {
+		fmt.Fprintln(os.Stderr, fm.fatalErr)
+		os.Exit(1)
+	}
 }
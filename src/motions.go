@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"time"
+)
+
+// Says whether row of region is somewhere a motion should stop.
+type rowMatcher func(region VRegion, row int) bool
+
+// Moves the cursor to the nearest row after it (or before, with a negative
+// direction) which match accepts. Returns false if there isn't one, leaving
+// the cursor where it is.
+func (m *Model) jumpTo(direction int, match rowMatcher) bool {
+	d := Signum(direction)
+	region, relCursor := m.getCursorTarget(m.cursor)
+
+	regionIdx := 0
+	start := 0
+	for m.regions[regionIdx] != region {
+		start += m.regions[regionIdx].Height()
+		regionIdx++
+	}
+
+	row := relCursor + d
+	for {
+		if row < 0 || row >= region.Height() {
+			regionIdx += d
+			if regionIdx < 0 || regionIdx >= len(m.regions) {
+				return false
+			}
+
+			if d > 0 {
+				start += region.Height()
+				region = m.regions[regionIdx]
+				row = 0
+			} else {
+				region = m.regions[regionIdx]
+				start -= region.Height()
+				row = region.Height() - 1
+			}
+			continue
+		}
+
+		if match(region, row) {
+			break
+		}
+		row += d
+	}
+
+	m.cursor = start + row
+	if m.cursor < m.y || m.cursor >= m.y+m.viewHeight() {
+		// Leave some of what comes before in view
+		m.y = Max(m.cursor-m.viewHeight()/3, 0)
+	}
+	m.clampCursor()
+
+	return true
+}
+
+// Runs a jump count times, stopping early if it runs out of places to go.
+func (m Model) repeatJump(count int, direction int, match rowMatcher, notFound string) (tea.Model, tea.Cmd) {
+	if len(m.regions) == 0 {
+		return m, nil
+	}
+
+	for i := 0; i < count; i++ {
+		if !(&m).jumpTo(direction, match) {
+			if i == 0 {
+				return m.displayStatusMessage(notFound, 3*time.Second)
+			}
+			break
+		}
+	}
+
+	return m, nil
+}
+
+func isHeaderRow(region VRegion, row int) bool {
+	return row == 0
+}
+
+// The first line of each run of changes, much like the start of a hunk.
+func isHunkStart(region VRegion, row int) bool {
+	fr, ok := region.(*FileRegion)
+	if !ok || fr.collapsed || fr.GetRowType(row) != FRLine || fr.lineMap[row] == FRBlank {
+		return false
+	}
+
+	lineIdx, _ := DivMod(fr.lineMap[row], NUM_FR_TYPES)
+	if !fr.ff.opts.IsChange(fr.ff.lines[lineIdx]) {
+		return false
+	}
+
+	// Comments can sit between two changed lines, so skip over them
+	for prev := row - 1; prev > 0; prev-- {
+		objIdx, objType := DivMod(fr.lineMap[prev], NUM_FR_TYPES)
+		switch {
+		case fr.lineMap[prev] == FRBlank || objType == FRComment:
+			continue
+		case objType == FRLine:
+			return !fr.ff.opts.IsChange(fr.ff.lines[objIdx])
+		}
+
+		return true
+	}
+
+	return true
+}
+
+func isCommentRow(region VRegion, row int) bool {
+	fr, ok := region.(*FileRegion)
+	if !ok || fr.collapsed || row <= 0 || fr.lineMap[row] == FRBlank {
+		return false
+	}
+
+	_, objType := DivMod(fr.lineMap[row], NUM_FR_TYPES)
+	return objType == FRComment
+}
+
+func isPendingCommentRow(region VRegion, row int) bool {
+	if !isCommentRow(region, row) {
+		return false
+	}
+
+	fr := region.(*FileRegion)
+	objIdx, _ := DivMod(fr.lineMap[row], NUM_FR_TYPES)
+	return fr.comments[objIdx].IsPending()
+}
+
+// Marks are named by a single key, like vim's.
+func validMarkName(name string) bool {
+	return len(name) == 1 && name[0] > ' ' && name[0] <= '~'
+}
+
+func (m Model) setMark(name string) (tea.Model, tea.Cmd) {
+	if !validMarkName(name) {
+		return m.displayStatusMessage(fmt.Sprintf("ERR: %q can't be used as a mark.", name), 3*time.Second)
+	}
+	if len(m.regions) == 0 {
+		return m, nil
+	}
+
+	if m.marks == nil {
+		m.marks = make(map[string]cursorAnchor)
+	}
+	m.marks[name] = m.anchorCursor()
+
+	return m.displayStatusMessage(fmt.Sprintf("Set mark '%s.", name), 3*time.Second)
+}
+
+// Puts the cursor back where mark name was set. Anchors are used rather than
+// rows, so marks stay put while files are collapsed and expanded or comments
+// come and go.
+func (m Model) jumpToMark(name string) (tea.Model, tea.Cmd) {
+	mark, ok := m.marks[name]
+	if !ok {
+		return m.displayStatusMessage(fmt.Sprintf("ERR: Mark '%s isn't set.", name), 3*time.Second)
+	}
+
+	for _, region := range m.regions {
+		if region != mark.region {
+			continue
+		}
+
+		if mark.anchor.objType != FRHeader {
+			region.SetECState(false)
+		}
+		mark.screenOffset = Clamp(0, mark.screenOffset, m.viewHeight()-1)
+		(&m).restoreCursor(mark)
+		(&m).clampCursor()
+
+		return m, nil
+	}
+
+	for _, region := range m.mrRegions {
+		if region == mark.region {
+			return m.displayStatusMessage(fmt.Sprintf("ERR: Mark '%s is in the whole MR, not this commit.", name), 3*time.Second)
+		}
+	}
+
+	// The file was reloaded since, e.g. after a new push
+	delete(m.marks, name)
+	return m.displayStatusMessage(fmt.Sprintf("ERR: Mark '%s is gone.", name), 3*time.Second)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Rows scrolled by each notch of the mouse wheel.
+const wheelStep = 3
+
+// Scrolls with the wheel and moves the cursor to whatever is clicked on. The
+// diff is the only thing drawn, so there's no file list to click in; once
+// there's a sidebar its clicks belong here too.
+func (m Model) handleMouse(msg tea.MouseMsg) (tea.Model, tea.Cmd) {
+	if len(m.regions) == 0 {
+		return m, nil
+	}
+
+	switch msg.Type {
+	case tea.MouseWheelUp:
+		(&m).scrollBy(-wheelStep)
+	case tea.MouseWheelDown:
+		(&m).scrollBy(wheelStep)
+	case tea.MouseLeft:
+		row := m.rowAtScreen(msg.Y)
+		if row < 0 {
+			return m, nil
+		}
+
+		(&m).placeCursor(row, -1)
+		(&m).scrollToCursor()
+
+		// Clicks do what enter would on headers and hidden lines
+		region, relCursor := m.getCursorTarget(m.cursor)
+		switch region.GetRowType(relCursor) {
+		case FRHeader:
+			return m.runAction("header_toggle", nil)
+		case FRAbr:
+			return m.runAction("expand_abridgement", nil)
+		}
+	}
+
+	return m, nil
+}
+
+// The row shown at screen row y, or -1 if there isn't one. Of the sticky
+// rows, only the header stands for a row.
+func (m Model) rowAtScreen(y int) int {
+	row := m.y + y
+	if y < 0 || y >= m.viewHeight() || row >= m.totalHeight() {
+		return -1
+	}
+
+	region, startLine := m.getCursorTarget(m.y)
+	if y < region.StickyRows(startLine) {
+		if y == 0 {
+			return m.y - startLine
+		}
+		return -1
+	}
+
+	return row
+}
+
+// Puts the cursor on the object at row, looking in direction for one if row
+// is part of something else, like the rest of a comment.
+func (m *Model) placeCursor(row int, direction int) {
+	region, relCursor := m.getCursorTarget(row)
+	m.cursor = row - relCursor + region.GetNextCursorTarget(relCursor, direction)
+}
+
+// Scrolls the view without moving the cursor, unless it would go off screen.
+func (m *Model) scrollBy(delta int) {
+	m.y = Clamp(0, m.y+delta, Max(m.totalHeight()-m.viewHeight(), 0))
+
+	top := m.y + m.stickyRows()
+	bottom := Min(m.y+m.viewHeight(), m.totalHeight()) - 1
+	if m.cursor < top {
+		m.placeCursor(Min(top, bottom), 1)
+	} else if m.cursor > bottom {
+		m.placeCursor(bottom, -1)
+	}
+}
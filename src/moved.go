@@ -0,0 +1,222 @@
+package main
+
+import (
+	tea "github.com/charmbracelet/bubbletea"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Like git's --color-moved=blocks, a run of removed lines only counts as
+// moved if it's long enough not to be a coincidence.
+const (
+	movedMinLines = 3
+	movedMinChars = 20
+)
+
+// Lines which turn up more often than this among the added lines, like
+// "return nil", are too common to say where anything was moved to, and only
+// make finding moves slow.
+const movedMaxCandidates = 32
+
+type movedLineRef struct {
+	file int
+	idx  int
+}
+
+// The parts of a file's lines which moves are found from, copied so they can
+// be read away from the UI goroutine.
+type movedFile struct {
+	region *FileRegion
+	ff     *FormattedFile
+	keys   []string
+	modes  []Mode
+}
+
+type movedPair struct {
+	from *FormattedLine
+	to   *FormattedLine
+}
+
+type MovesDetectedMsg struct {
+	files []movedFile
+	moves []movedPair
+}
+
+func movedKey(line *FormattedLine) string {
+	return strings.Join(strings.Fields(line.Text()), " ")
+}
+
+func alnumCount(s string) int {
+	count := 0
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Finds moved lines across regions in the background. They're linked up in
+// applyMoves once found.
+func (m Model) detectMoves(regions []VRegion) tea.Cmd {
+	if !CFG.Diff.DetectMoves {
+		return nil
+	}
+
+	var files []movedFile
+	for _, region := range regions {
+		fr, ok := region.(*FileRegion)
+		if !ok {
+			continue
+		}
+
+		file := movedFile{
+			region: fr,
+			ff:     fr.ff,
+			keys:   make([]string, len(fr.ff.lines)),
+			modes:  make([]Mode, len(fr.ff.lines)),
+		}
+		for idx, line := range fr.ff.lines {
+			file.modes[idx] = line.mode
+			if line.mode != UNCHANGED {
+				file.keys[idx] = movedKey(line)
+			}
+		}
+		files = append(files, file)
+	}
+
+	return func() tea.Msg {
+		return MovesDetectedMsg{files: files, moves: findMoves(files)}
+	}
+}
+
+// Finds blocks of removed lines which were added back elsewhere, in the same
+// file or another, pairing each line in them with its counterpart. Lines are
+// compared ignoring changes in indentation so code which was moved into or out
+// of a block is still found.
+func findMoves(files []movedFile) []movedPair {
+	added := make(map[string][]movedLineRef)
+	for fileIdx, file := range files {
+		for idx, key := range file.keys {
+			// Blank lines and lone brackets match almost anywhere
+			if file.modes[idx] == ADDED && alnumCount(key) > 0 {
+				added[key] = append(added[key], movedLineRef{fileIdx, idx})
+			}
+		}
+	}
+
+	matched := make([][]bool, len(files))
+	for fileIdx, file := range files {
+		matched[fileIdx] = make([]bool, len(file.keys))
+	}
+
+	// How far the lines from src (removed) and dst (added) match up
+	matchLength := func(src movedLineRef, dst movedLineRef) int {
+		srcFile, dstFile := files[src.file], files[dst.file]
+
+		n := 0
+		for src.idx+n < len(srcFile.keys) && dst.idx+n < len(dstFile.keys) {
+			s, d := src.idx+n, dst.idx+n
+			if srcFile.modes[s] != REMOVED || dstFile.modes[d] != ADDED {
+				break
+			}
+			if matched[src.file][s] || matched[dst.file][d] || srcFile.keys[s] != dstFile.keys[d] {
+				break
+			}
+			n++
+		}
+
+		return n
+	}
+
+	var moves []movedPair
+	for fileIdx, file := range files {
+		for idx := 0; idx < len(file.keys); idx++ {
+			if file.modes[idx] != REMOVED || matched[fileIdx][idx] {
+				continue
+			}
+
+			candidates := added[file.keys[idx]]
+			if len(candidates) > movedMaxCandidates {
+				continue
+			}
+
+			src := movedLineRef{fileIdx, idx}
+			var best movedLineRef
+			bestLen := 0
+			for _, dst := range candidates {
+				if n := matchLength(src, dst); n > bestLen {
+					best, bestLen = dst, n
+				}
+			}
+
+			if bestLen < movedMinLines || alnumCount(strings.Join(file.keys[idx:idx+bestLen], "")) < movedMinChars {
+				continue
+			}
+
+			for i := 0; i < bestLen; i++ {
+				matched[fileIdx][idx+i] = true
+				matched[best.file][best.idx+i] = true
+				moves = append(moves, movedPair{
+					from: file.ff.lines[idx+i],
+					to:   files[best.file].ff.lines[best.idx+i],
+				})
+			}
+			idx += bestLen - 1
+		}
+	}
+
+	return moves
+}
+
+// Links up the lines of moves found by detectMoves, unless any of the files
+// has had its diff swapped since, in which case they're being found again.
+func (m Model) applyMoves(msg MovesDetectedMsg) (tea.Model, tea.Cmd) {
+	for _, file := range msg.files {
+		if file.region.ff != file.ff {
+			return m, nil
+		}
+	}
+
+	for _, file := range msg.files {
+		for _, line := range file.ff.lines {
+			line.moved = nil
+		}
+	}
+	for _, move := range msg.moves {
+		move.from.moved, move.to.moved = move.to, move.from
+	}
+
+	return m, nil
+}
+
+// Moves the cursor to the other end of the move the line under it is part
+// of, if it is.
+func (m Model) jumpToMoved() (tea.Model, tea.Cmd) {
+	region, relCursor := m.getCursorTarget(m.cursor)
+	anchor := region.GetAnchor(relCursor)
+	if anchor.objType != FRLine || anchor.line.moved == nil {
+		return m.displayStatusMessage("This line hasn't been moved.", 3*time.Second)
+	}
+
+	target := anchor.line.moved
+	for _, region := range m.regions {
+		fr, ok := region.(*FileRegion)
+		if !ok || !fr.containsLine(target) {
+			continue
+		}
+
+		fr.SetECState(false)
+		(&m).restoreCursor(cursorAnchor{
+			region:       fr,
+			anchor:       Anchor{objType: FRLine, line: target},
+			screenOffset: m.viewHeight() / 3,
+		})
+		(&m).clampCursor()
+		break
+	}
+
+	return m, nil
+}
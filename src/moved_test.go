@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Builds a region with a line for each of texts, where a leading '+' or '-'
+// marks the line as added or removed.
+func movedRegionOf(texts ...string) *FileRegion {
+	ff := &FormattedFile{}
+	for _, text := range texts {
+		line := lineOf(text)
+		switch text[0] {
+		case '+':
+			line = lineOf(text[1:])
+			line.mode = ADDED
+		case '-':
+			line = lineOf(text[1:])
+			line.mode = REMOVED
+		}
+		ff.lines = append(ff.lines, line)
+	}
+
+	return &FileRegion{ff: ff}
+}
+
+func findAndApplyMoves(t *testing.T, regions ...VRegion) {
+	t.Helper()
+
+	cmd := Model{}.detectMoves(regions)
+	if cmd == nil {
+		t.Fatal("detectMoves() returned no command")
+	}
+	Model{}.applyMoves(cmd().(MovesDetectedMsg))
+}
+
+func TestDetectMoves(t *testing.T) {
+	from := movedRegionOf(
+		" keep",
+		"-func moved() {",
+		"-	doSomething(first)",
+		"-	doSomething(second)",
+		"-}",
+		"-short",
+	)
+	to := movedRegionOf(
+		"+func moved() {",
+		"+doSomething(first)",
+		"+doSomething(second)",
+		"+}",
+		"+not short",
+	)
+
+	findAndApplyMoves(t, from, &PlaceholderRegion{}, to)
+
+	for idx := 1; idx <= 4; idx++ {
+		if from.ff.lines[idx].moved != to.ff.lines[idx-1] || to.ff.lines[idx-1].moved != from.ff.lines[idx] {
+			t.Errorf("Line %d isn't linked to where it was moved to", idx)
+		}
+	}
+	if from.ff.lines[0].moved != nil || from.ff.lines[5].moved != nil {
+		t.Error("Lines outside the moved block are linked")
+	}
+}
+
+func TestDetectMovesStale(t *testing.T) {
+	region := movedRegionOf("-aaaaaaaa", "-bbbbbbbb", "-cccccccc", "+aaaaaaaa", "+bbbbbbbb", "+cccccccc")
+
+	cmd := Model{}.detectMoves([]VRegion{region})
+	region.ff = movedRegionOf("-aaaaaaaa").ff
+	Model{}.applyMoves(cmd().(MovesDetectedMsg))
+
+	if region.ff.lines[0].moved != nil {
+		t.Error("Moves found in a replaced diff were applied")
+	}
+}
+
+// Lines common enough to be added all over the place shouldn't make finding
+// moves quadratic.
+func TestDetectMovesCommonLines(t *testing.T) {
+	var from, to []string
+	for i := 0; i < 20000; i++ {
+		from = append(from, "-return nil", "-}", "-")
+		to = append(to, "+return nil", "+}", "+")
+	}
+	from = append(from, "-one moved line", "-another moved line", "-the last moved line")
+	to = append(to, "+one moved line", "+another moved line", "+the last moved line")
+	for i := 0; i < 3; i++ {
+		from = append(from, fmt.Sprintf("-unique line %d", i))
+	}
+
+	fromRegion, toRegion := movedRegionOf(from...), movedRegionOf(to...)
+	start := time.Now()
+	findAndApplyMoves(t, fromRegion, toRegion)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Finding moves took %s", elapsed)
+	}
+
+	moved := fromRegion.ff.lines[len(from)-6]
+	if moved.moved != toRegion.ff.lines[len(to)-3] {
+		t.Error("The moved block wasn't found among common lines")
+	}
+}
@@ -20,11 +20,15 @@ type DiffLine struct {
 	mode Mode
 	aNum int
 	bNum int
+	// The section heading from the header of the hunk the line came from,
+	// usually the enclosing function
+	section string
 }
 
 type Hunk struct {
 	baseStart int
 	baseEnd   int
+	section   string
 	lines     []*DiffLine
 }
 
@@ -69,32 +73,36 @@ func parseHunks(diffLines []string) ([]*Hunk, error) {
 
 			hunk = &Hunk{
 				baseStart: aLine,
+				section:   strings.TrimSpace(matches[5]),
 			}
 
 		case strings.HasPrefix(line, "+"):
 			line := DiffLine{
-				text: line[1:],
-				mode: ADDED,
-				aNum: aLine,
-				bNum: bLine,
+				text:    line[1:],
+				mode:    ADDED,
+				aNum:    aLine,
+				bNum:    bLine,
+				section: hunk.section,
 			}
 			hunk.lines = append(hunk.lines, &line)
 			bLine++
 		case strings.HasPrefix(line, "-"):
 			line := DiffLine{
-				text: line[1:],
-				mode: REMOVED,
-				aNum: aLine,
-				bNum: bLine,
+				text:    line[1:],
+				mode:    REMOVED,
+				aNum:    aLine,
+				bNum:    bLine,
+				section: hunk.section,
 			}
 			hunk.lines = append(hunk.lines, &line)
 			aLine++
 		case strings.HasPrefix(line, " "):
 			line := DiffLine{
-				text: line[1:],
-				mode: UNCHANGED,
-				aNum: aLine,
-				bNum: bLine,
+				text:    line[1:],
+				mode:    UNCHANGED,
+				aNum:    aLine,
+				bNum:    bLine,
+				section: hunk.section,
 			}
 			hunk.lines = append(hunk.lines, &line)
 
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"strings"
+	"time"
+)
+
+type RefreshTickMsg struct{}
+
+type RefreshMsg struct {
+	discussions []GLDiscussion
+	diffRefs    *GLDiffRefs
+	err         error
+	manual      bool
+}
+
+// Where the cursor was, in terms of what it was on rather than which line.
+type cursorAnchor struct {
+	region       VRegion
+	anchor       Anchor
+	screenOffset int
+}
+
+func scheduleRefresh() tea.Cmd {
+	interval := CFG.Behavior.RefreshInterval
+	if interval <= 0 {
+		return nil
+	}
+
+	return tea.Tick(interval, func(_ time.Time) tea.Msg {
+		return RefreshTickMsg{}
+	})
+}
+
+func (m Model) startRefresh(manual bool) (Model, tea.Cmd) {
+	m.refreshing = true
+	gl := m.gl
+	mr := m.mr
+
+	return m, func() tea.Msg {
+		msg := RefreshMsg{manual: manual}
+
+		msg.discussions, msg.err = gl.FetchDiscussions(mr.ProjectId, mr.Iid)
+		if msg.err != nil {
+			return msg
+		}
+		msg.diffRefs, msg.err = gl.FetchDiffRefs(mr.ProjectId, mr.Iid)
+
+		return msg
+	}
+}
+
+func (m Model) finishRefresh(msg RefreshMsg) (tea.Model, tea.Cmd) {
+	var next tea.Cmd
+	m.refreshing = false
+	if !msg.manual {
+		next = scheduleRefresh()
+	}
+
+	if msg.err != nil {
+		model, cmd := m.displayStatusMessage(
+			fmt.Sprintf("ERR: Unable to refresh: %s", msg.err),
+			3*time.Second,
+		)
+		return model, tea.Batch(next, cmd)
+	}
+
+	notesByFile := diffNotesByFile(msg.discussions)
+
+	var added, changed, removed int
+	anchor := m.anchorCursor()
+	vp := m.viewParams(0)
+
+	for _, region := range m.mrRegionList() {
+		fr, ok := region.(*FileRegion)
+		if !ok {
+			continue
+		}
+
+		vp.lineNoColWidth = fr.lineNoColWidth
+		a, c, r := fr.MergeComments(notesByFile[fr.newPath], vp)
+		added += a
+		changed += c
+		removed += r
+	}
+	// A commit's files share the MR's notes, so only new ones are added here
+	if m.viewedCommit != nil {
+		for _, region := range m.regions {
+			if fr, ok := region.(*FileRegion); ok {
+				vp.lineNoColWidth = fr.lineNoColWidth
+				fr.MergeComments(notesByFile[fr.newPath], vp)
+			}
+		}
+	}
+
+	(&m).restoreCursor(anchor)
+	m.mr.Discussions = msg.discussions
+
+	pushes := 0
+	if msg.diffRefs.HeadSHA != m.headSHA {
+		m.headSHA = msg.diffRefs.HeadSHA
+		pushes = 1
+		next = tea.Batch(next, m.loadCommits())
+	}
+
+	summary := describeRefresh(added, changed, removed, pushes)
+	if summary == "" {
+		if !msg.manual {
+			return m, next
+		}
+		summary = "No new activity."
+	}
+
+	model, cmd := m.displayStatusMessage(summary, 5*time.Second)
+	return model, tea.Batch(next, cmd)
+}
+
+func describeRefresh(added int, changed int, removed int, pushes int) string {
+	var parts []string
+
+	plural := func(n int, singular string, multiple string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, singular)
+		}
+		return fmt.Sprintf("%d %s", n, multiple)
+	}
+
+	if added > 0 {
+		parts = append(parts, plural(added, "new comment", "new comments"))
+	}
+	if changed > 0 {
+		parts = append(parts, plural(changed, "edited comment", "edited comments"))
+	}
+	if removed > 0 {
+		parts = append(parts, plural(removed, "deleted comment", "deleted comments"))
+	}
+	if pushes > 0 {
+		parts = append(parts, plural(pushes, "new push (reopen the MR to view)", "new pushes (reopen the MR to view)"))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (m Model) anchorCursor() cursorAnchor {
+	if len(m.regions) == 0 {
+		return cursorAnchor{}
+	}
+
+	region, relCursor := m.getCursorTarget(m.cursor)
+	return cursorAnchor{
+		region:       region,
+		anchor:       region.GetAnchor(relCursor),
+		screenOffset: m.cursor - m.y,
+	}
+}
+
+// Puts the cursor back on whatever it was on when the anchor was taken,
+// keeping it at the same height on screen where possible.
+func (m *Model) restoreCursor(a cursorAnchor) {
+	cumY := 0
+
+	for _, region := range m.regions {
+		if region == a.region {
+			m.cursor = cumY + region.ResolveAnchor(a.anchor)
+			m.y = Max(0, m.cursor-a.screenOffset)
+			return
+		}
+		cumY += region.Height()
+	}
+}
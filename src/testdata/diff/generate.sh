@@ -0,0 +1,13 @@
+#!/bin/sh
+# Regenerates each case's expected diffs with git, which diff_test.go checks
+# DiffContents against. Every case is a directory holding base and head.
+cd "$(dirname "$0")" || exit 1
+
+for dir in */; do
+	dir=${dir%/}
+	for algorithm in myers patience histogram; do
+		git -c core.quotePath=false diff --no-index --no-color --no-ext-diff \
+			--no-indent-heuristic --diff-algorithm="$algorithm" --unified=1000000 \
+			"$dir/base" "$dir/head" >"$dir/$algorithm.diff"
+	done
+done
@@ -1,7 +1,11 @@
 package main
 
 import (
-	"math"
+	"github.com/mattn/go-runewidth"
+	"github.com/rivo/uniseg"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func Min(x, y int) int {
@@ -18,6 +22,20 @@ func Max(x, y int) int {
 	return y
 }
 
+func MinDuration(x, y time.Duration) time.Duration {
+	if x > y {
+		return y
+	}
+	return x
+}
+
+func MaxDuration(x, y time.Duration) time.Duration {
+	if x > y {
+		return x
+	}
+	return y
+}
+
 func Clamp(x, n, y int) int {
 	return Max(x, Min(y, n))
 }
@@ -38,7 +56,84 @@ func GetLineNoColWidth(ff *FormattedFile) int {
 
 	lastLine := ff.lines[count-1]
 	maxLineNo := Max(lastLine.aNum, lastLine.bNum)
-	return int(math.Log10(float64(maxLineNo)) + 1.0)
+	return len(strconv.Itoa(maxLineNo))
+}
+
+// How many terminal cells s takes up. Wide characters like CJK take two,
+// combining marks and the like are counted as part of what they combine with.
+func cellWidth(s string) int {
+	return runewidth.StringWidth(s)
+}
+
+// Breaks s into lines at most width cells wide, at spaces where possible.
+// Tabs go to the next multiple of four columns. A character wider than width
+// gets a line of its own rather than being split.
+func wrapText(s string, width int) []string {
+	var lines []string
+
+	for _, para := range strings.Split(s, "\n") {
+		var line strings.Builder
+		lineWidth := 0
+		started := false
+
+		flush := func() {
+			lines = append(lines, line.String())
+			line.Reset()
+			lineWidth = 0
+			started = false
+		}
+
+		for _, word := range strings.Split(expandTabs(para, 4), " ") {
+			wordWidth := cellWidth(word)
+			if started && lineWidth+1+wordWidth > width {
+				flush()
+			} else if started {
+				line.WriteString(" ")
+				lineWidth++
+			}
+
+			// Words too long for a line of their own are split between
+			// characters
+			g := uniseg.NewGraphemes(word)
+			for g.Next() {
+				clusterWidth := cellWidth(g.Str())
+				if lineWidth > 0 && lineWidth+clusterWidth > width {
+					flush()
+				}
+				line.WriteString(g.Str())
+				lineWidth += clusterWidth
+			}
+			started = true
+		}
+
+		flush()
+	}
+
+	return lines
+}
+
+// Replaces each tab in s with spaces up to the next multiple of tabWidth.
+func expandTabs(s string, tabWidth int) string {
+	if !strings.Contains(s, "\t") {
+		return s
+	}
+
+	var b strings.Builder
+	col := 0
+	g := uniseg.NewGraphemes(s)
+	for g.Next() {
+		if g.Str() == "\t" {
+			spaces := tabWidth - col%tabWidth
+			b.WriteString(strings.Repeat(" ", spaces))
+			col += spaces
+			continue
+		}
+
+		b.WriteString(g.Str())
+		col += cellWidth(g.Str())
+	}
+
+	return b.String()
 }
 
 func DivMod(numerator int, denominator int) (q int, r int) {
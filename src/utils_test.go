@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// Emoji joined into one character by zero width joiners, written out since
+// the joiners are invisible
+const (
+	zwjFamily       = "\U0001F468\u200d\U0001F469\u200d\U0001F467"
+	zwjTechnologist = "\U0001F469\u200d\U0001F4BB"
+)
+
+var ansiPattern = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func stripANSI(s string) string {
+	return ansiPattern.ReplaceAllString(s, "")
+}
+
+func TestCellWidth(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{"empty", "", 0},
+		{"ascii", "hello", 5},
+		{"cjk", "漢字", 4},
+		{"hangul", "한국어", 6},
+		{"halfwidth katakana", "ｱｲ", 2},
+		{"mixed cjk", "a漢b", 4},
+		{"combining acute", "cafe\u0301", 4},
+		{"stacked combining marks", "a\u0323\u0301b", 2},
+		{"precomposed", "caf\u00e9", 4},
+		{"emoji", "👍", 2},
+		{"emoji with skin tone", "👍🏽", 2},
+		{"emoji zwj family", zwjFamily, 2},
+		{"emoji zwj in text", "a" + zwjTechnologist + "b", 4},
+		{"two zwj sequences", zwjFamily + zwjTechnologist, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cellWidth(tt.in); got != tt.want {
+				t.Errorf("cellWidth(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		width int
+		want  []string
+	}{
+		{"fits", "short text", 20, []string{"short text"}},
+		{"at spaces", "one two three", 8, []string{"one two", "three"}},
+		{"newlines kept", "one\ntwo", 20, []string{"one", "two"}},
+		{"long word split", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"cjk split between characters", "漢字漢字漢", 5, []string{"漢字", "漢字", "漢"}},
+		{"zwj sequence kept whole", "ab" + zwjFamily, 3, []string{"ab", zwjFamily}},
+		{"combining mark kept with its letter", "cafe\u0301s", 4, []string{"cafe\u0301", "s"}},
+		{"wide character on a narrow line", "漢", 1, []string{"漢"}},
+		{"tabs expanded", "a\tb", 20, []string{"a   b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := wrapText(tt.in, tt.width)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wrapText(%q, %d) = %q, want %q", tt.in, tt.width, got, tt.want)
+			}
+			for _, line := range got {
+				if cellWidth(line) > tt.width && len([]rune(line)) > 1 {
+					t.Errorf("Line %q is %d cells, more than %d", line, cellWidth(line), tt.width)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"github.com/atotto/clipboard"
+	"github.com/aymanbagabas/go-osc52"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Rows picked out with visual_line, running from start to the cursor. A
+// selection stays within the region it was started in.
+type lineSelection struct {
+	region VRegion
+	start  int
+}
+
+// The row at the top of region.
+func (m Model) regionStart(region VRegion) int {
+	start := 0
+	for _, r := range m.regions {
+		if r == region {
+			break
+		}
+		start += r.Height()
+	}
+
+	return start
+}
+
+// The rows of region which are selected, if any are.
+func (m Model) selectedRows(region VRegion) (lo int, hi int, ok bool) {
+	if m.selection == nil || m.selection.region != region {
+		return 0, 0, false
+	}
+
+	// The region can shrink underneath the selection, e.g. when collapsed
+	start := Min(m.selection.start, region.Height()-1)
+	cursor := Clamp(0, m.cursor-m.regionStart(region), region.Height()-1)
+	return Min(start, cursor), Max(start, cursor), true
+}
+
+func (m Model) toggleSelection() (tea.Model, tea.Cmd) {
+	if m.selection != nil || len(m.regions) == 0 {
+		m.selection = nil
+		return m, nil
+	}
+
+	region, relCursor := m.getCursorTarget(m.cursor)
+	if _, ok := region.(*FileRegion); !ok || region.GetRowType(relCursor) == FRHeader {
+		return m.displayStatusMessage("Only lines of code can be selected.", 3*time.Second)
+	}
+	m.selection = &lineSelection{region: region, start: relCursor}
+
+	return m, nil
+}
+
+// Puts text on the clipboard. OSC 52 asks the terminal to do it, which works
+// over SSH and in tmux, and the system clipboard is tried as well for
+// terminals which don't support that. The escape sequence is written to the
+// terminal in one go rather than printed through tea, whose renderer cuts
+// printed lines to the terminal's width and would truncate it.
+func copyText(text string) tea.Cmd {
+	var seq strings.Builder
+	osc52.NewOutput(&seq, os.Environ()).Copy(text)
+
+	return func() tea.Msg {
+		if _, err := os.Stdout.WriteString(seq.String()); err != nil {
+			log.Debug().Err(err).Msg("Unable to write the OSC 52 sequence.")
+		}
+		if err := clipboard.WriteAll(text); err != nil {
+			log.Debug().Err(err).Msg("Unable to use the system clipboard, relying on OSC 52.")
+		}
+		return nil
+	}
+}
+
+func (m Model) yank(text string, what string) (tea.Model, tea.Cmd) {
+	m.selection = nil
+
+	next, statusCmd := m.displayStatusMessage(fmt.Sprintf("Copied %s.", what), 3*time.Second)
+	return next, tea.Batch(copyText(text), statusCmd)
+}
+
+// The code in rows lo to hi of f, including any lines hidden between them.
+func (f *FileRegion) textOfRows(lo int, hi int) []string {
+	var lines []string
+	for row := lo; row <= hi; row++ {
+		if f.lineMap[row] == FRBlank {
+			continue
+		}
+
+		objIdx, objType := DivMod(f.lineMap[row], NUM_FR_TYPES)
+		switch objType {
+		case FRLine:
+			lines = append(lines, f.ff.lines[objIdx].Text())
+		case FRAbr:
+			for _, line := range f.ff.lines[f.abrs[objIdx].start : f.abrs[objIdx].end+1] {
+				lines = append(lines, line.Text())
+			}
+		}
+	}
+
+	return lines
+}
+
+// A link to the lines from first to last on GitLab which will always show
+// the same code, since it names the commit rather than a branch. Both must be
+// in the same file, and the link is to whichever side first is on.
+func (m Model) permalink(first cursorLocation, last cursorLocation) string {
+	path, ref, firstNo := first.revision(m.refsOf(first.region))
+	lastNo := last.lineNoOn(first.onBase())
+
+	segments := strings.Split(path, "/")
+	for idx, segment := range segments {
+		segments[idx] = url.PathEscape(segment)
+	}
+
+	link := fmt.Sprintf(
+		"%s/%s/-/blob/%s/%s#L%d",
+		m.initData.glHost,
+		m.initData.project,
+		ref,
+		strings.Join(segments, "/"),
+		firstNo,
+	)
+	if lastNo > firstNo {
+		link += fmt.Sprintf("-%d", lastNo)
+	}
+
+	return link
+}
+
+func (m Model) yankLine() (tea.Model, tea.Cmd) {
+	loc, ok := m.cursorLocation()
+	if !ok || loc.line == nil {
+		return m, nil
+	}
+
+	return m.yank(loc.line.Text(), "line")
+}
+
+func (m Model) yankNote() (tea.Model, tea.Cmd) {
+	loc, ok := m.cursorLocation()
+	if !ok || loc.note == nil {
+		return m, nil
+	}
+
+	return m.yank(loc.note.Body, "comment")
+}
+
+func (m Model) yankPermalink() (tea.Model, tea.Cmd) {
+	loc, ok := m.cursorLocation()
+	if !ok {
+		return m, nil
+	}
+
+	return m.yank(m.permalink(loc, loc), "permalink")
+}
+
+func (m Model) yankSelection() (tea.Model, tea.Cmd) {
+	region := m.selection.region
+	lo, hi, _ := m.selectedRows(region)
+	lines := region.(*FileRegion).textOfRows(lo, hi)
+
+	return m.yank(strings.Join(lines, "\n")+"\n", fmt.Sprintf("%d lines", len(lines)))
+}
+
+func (m Model) yankSelectionPermalink() (tea.Model, tea.Cmd) {
+	fr := m.selection.region.(*FileRegion)
+	lo, hi, _ := m.selectedRows(fr)
+
+	first := cursorLocation{region: fr, line: fr.GetAnchor(lo).line}
+	last := cursorLocation{region: fr, line: fr.GetAnchor(hi).line}
+	// The anchor of hidden lines is the first of them
+	if objIdx, objType := DivMod(fr.lineMap[hi], NUM_FR_TYPES); objType == FRAbr {
+		last.line = fr.ff.lines[fr.abrs[objIdx].end]
+	}
+
+	return m.yank(m.permalink(first, last), "permalink")
+}